@@ -1,8 +1,32 @@
 package entity
 
+import (
+	"strconv"
+	"strings"
+)
+
 const (
-	SaltLen     = 32
-	TokenExpire = 2 * 60 * 60
+	SaltLen            = 32
+	TokenExpire        = 2 * 60 * 60
+	RefreshTokenExpire = 30 * 24 * 60 * 60
+	ResetCodeExpire    = 15 * 60
+	MFAChallengeExpire = 5 * 60
+	// MFAAttempts wrong codes tolerated before an MFA challenge is dropped
+	MFAAttempts = 5
+	// RecoveryCodeCount single-use recovery codes generated when MFA is enabled
+	RecoveryCodeCount = 10
+	// WebAuthnChallengeExpire time a registration or login ceremony may take
+	WebAuthnChallengeExpire = 5 * 60
+	// LockoutWindow failed logins are forgotten this long after the last one
+	LockoutWindow = 15 * 60
+	// LockoutMax longest lockout the backoff grows to
+	LockoutMax = 60 * 60
+	// ResetCodeAttempts wrong codes tolerated before a reset code is dropped
+	ResetCodeAttempts = 5
+	// ScopeSep separates the role and the resource of a scoped binding, role@resource
+	ScopeSep = "@"
+	// AdminRole role allowed to call the management APIs
+	AdminRole = "admin"
 )
 
 // UserReq create or delete user request
@@ -11,9 +35,99 @@ type UserReq struct {
 	Password string `json:"password,omitempty"`
 }
 
-// RoleReq create or delete role request
+// RoleReq create or delete role, add or remove child role request
 type RoleReq struct {
-	RoleName string `json:"role_name,omitempty"`
+	RoleName  string `json:"role_name,omitempty"`
+	ChildRole string `json:"child_role,omitempty"`
+}
+
+// PasswordReq change or reset password request
+type PasswordReq struct {
+	UserName    string `json:"user_name,omitempty"`
+	Password    string `json:"password,omitempty"`
+	NewPassword string `json:"new_password,omitempty"`
+	Token       string `json:"token,omitempty"`
+	// Code password reset code delivered to the user
+	Code string `json:"code,omitempty"`
+	// ClientIP of the HTTP request, wrong current passwords count against it
+	ClientIP string `json:"-"`
+}
+
+// MFAReq TOTP enrollment or second factor request
+type MFAReq struct {
+	Token    string `json:"token,omitempty"`
+	MFAToken string `json:"mfa_token,omitempty"`
+	Code     string `json:"code,omitempty"`
+	// ClientIP of the HTTP request, wrong codes count against it
+	ClientIP string `json:"-"`
+}
+
+// MFARsp TOTP enrollment or recovery codes response
+type MFARsp struct {
+	Code   int    `json:"code"`
+	Msg    string `json:"msg"`
+	Secret string `json:"secret,omitempty"`
+	URI    string `json:"uri,omitempty"`
+	// RecoveryCodes shown once, only their hashes are kept
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	Remaining     int      `json:"remaining"`
+}
+
+// MFAChallenge authentication waiting for its second factor
+type MFAChallenge struct {
+	ID         string `json:"id,omitempty"`
+	UserName   string `json:"user_name,omitempty"`
+	ClientIP   string `json:"client_ip,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+	Attempts   int    `json:"attempts,omitempty"`
+	CreateTime int64  `json:"create_time,omitempty"`
+}
+
+// Key for searching
+func (m *MFAChallenge) Key() string {
+	return "mfa_" + m.ID
+}
+
+// SessionReq list or revoke sessions request, user_name defaults to the token user
+type SessionReq struct {
+	UserName  string `json:"user_name,omitempty"`
+	Token     string `json:"token,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// SessionRsp list sessions response
+type SessionRsp struct {
+	Code     int        `json:"code"`
+	Msg      string     `json:"msg"`
+	Sessions []*Session `json:"sessions"`
+}
+
+// Session login session as listed to its user
+type Session struct {
+	ID         string `json:"id"`
+	TokenID    string `json:"token_id"`
+	CreateTime int64  `json:"create_time"`
+	IssueTime  int64  `json:"issue_time"`
+	ExpireTime int64  `json:"expire_time"`
+	ClientIP   string `json:"client_ip"`
+	UserAgent  string `json:"user_agent"`
+	Current    bool   `json:"current,omitempty"`
+}
+
+// PermissionReq grant or revoke permission of a role, check permission of a user request
+type PermissionReq struct {
+	UserName   string `json:"user_name,omitempty"`
+	RoleName   string `json:"role_name,omitempty"`
+	Permission string `json:"permission,omitempty"`
+	Token      string `json:"token,omitempty"`
+	Resource   string `json:"resource,omitempty"`
+}
+
+// PermissionRsp check permission response
+type PermissionRsp struct {
+	Code        int    `json:"code"`
+	Msg         string `json:"msg"`
+	CheckResult bool   `json:"check_result"`
 }
 
 // CommRsp common response
@@ -24,32 +138,83 @@ type CommRsp struct {
 
 // UserRoleReq add role to user, check role request
 type UserRoleReq struct {
-	UserName string `json:"user_name,omitempty"`
-	Password string `json:"password,omitempty"`
-	RoleName string `json:"role_name,omitempty"`
-	Token    string `json:"token,omitempty"`
+	UserName     string `json:"user_name,omitempty"`
+	Password     string `json:"password,omitempty"`
+	RoleName     string `json:"role_name,omitempty"`
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// Resource path the binding is scoped to, such as project/42, global if empty
+	Resource string `json:"resource,omitempty"`
+	// NotBefore and ExpireAt unix time the binding is active from and until, unbounded if 0
+	NotBefore int64 `json:"not_before,omitempty"`
+	ExpireAt  int64 `json:"expire_at,omitempty"`
+	// Effective all roles including the inherited ones
+	Effective bool `json:"effective,omitempty"`
+	// ClientIP and UserAgent of the HTTP request, recorded with the session on authentication and refresh
+	ClientIP  string `json:"-"`
+	UserAgent string `json:"-"`
 }
 
-// Key user-role key
+// Key user-role key, bind_<len(user)>_<user>_<role>[@resource]. User and role names may hold
+// underscores, the length of the user name tells where it ends so that no two bindings share a key.
 func (ur *UserRoleReq) Key() string {
-	return "bind_" + ur.UserName + "_" + ur.RoleName
+	return "bind_" + strconv.Itoa(len(ur.UserName)) + "_" + ur.UserName + "_" + ur.ScopedRole()
+}
+
+// ScopedRole role entry of the binding in the user roles, role@resource if scoped
+func (ur *UserRoleReq) ScopedRole() string {
+	if ur.Resource == "" {
+		return ur.RoleName
+	}
+	return ur.RoleName + ScopeSep + ur.Resource
 }
 
 // UserRoleRsp authenticate, invalidate, check role, all roles response
 type UserRoleRsp struct {
-	Code        int      `json:"code"`
-	Msg         string   `json:"msg"`
-	Token       string   `json:"token,omitempty"`
-	CheckResult bool     `json:"check_result,omitempty"`
-	Roles       []string `json:"roles,omitempty"`
+	Code         int      `json:"code"`
+	Msg          string   `json:"msg"`
+	Token        string   `json:"token,omitempty"`
+	RefreshToken string   `json:"refresh_token,omitempty"`
+	CheckResult  bool     `json:"check_result,omitempty"`
+	Roles        []string `json:"roles,omitempty"`
+	// MFAPending the password was right, the challenge MFAToken is to be completed with a second factor
+	MFAPending bool   `json:"mfa_pending,omitempty"`
+	MFAToken   string `json:"mfa_token,omitempty"`
+}
+
+// SnapshotReq snapshot or restore request
+type SnapshotReq struct {
+	// Name file name in the snapshot directory
+	Name string `json:"name,omitempty"`
+}
+
+// SnapshotRsp snapshot or restore response
+type SnapshotRsp struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	Entries int    `json:"entries,omitempty"`
 }
 
 // User user
 type User struct {
-	UserName   string `json:"user_name,omitempty"`
-	Salt       []byte `json:"salt,omitempty"`
-	Password   []byte `json:"password,omitempty"`
-	CreateTime int64  `json:"create_time,omitempty"`
+	UserName string `json:"user_name,omitempty"`
+	// Salt and Password sha256(password||salt) of legacy records, replaced by PasswordHash on login
+	Salt     []byte `json:"salt,omitempty"`
+	Password []byte `json:"password,omitempty"`
+	// PasswordHash PHC-style string recording algorithm, parameters, salt and hash
+	PasswordHash string `json:"password_hash,omitempty"`
+	// PasswordHistory hashes of the previous passwords, the latest first
+	PasswordHistory []string `json:"password_history,omitempty"`
+	// CredVersion bumped on every password change, tokens carrying an older one are rejected
+	CredVersion int64 `json:"cred_version,omitempty"`
+	// TOTPSecret RFC 6238 secret, enrolled but not used until TOTPEnabled is confirmed
+	TOTPSecret  []byte `json:"totp_secret,omitempty"`
+	TOTPEnabled bool   `json:"totp_enabled,omitempty"`
+	// TOTPCounter time step of the last code accepted, older and equal steps are replays
+	TOTPCounter int64 `json:"totp_counter,omitempty"`
+	// RecoveryCodes sha256 of the unused recovery codes
+	RecoveryCodes [][]byte `json:"recovery_codes,omitempty"`
+	CreateTime    int64    `json:"create_time,omitempty"`
 }
 
 // Key for searching
@@ -62,6 +227,25 @@ func (u *User) UserRolesKey() string {
 	return "user_roles_" + u.UserName
 }
 
+// TokensKey for searching all issued tokens
+func (u *User) TokensKey() string {
+	return "user_tokens_" + u.UserName
+}
+
+// CredentialsKey for searching all WebAuthn credentials
+func (u *User) CredentialsKey() string {
+	return "user_credentials_" + u.UserName
+}
+
+// userKeyPrefixes user names starting with one of these would share keys with another user,
+// user_roles_x is both the roles key of x and the key of roles_x
+var userKeyPrefixes = []string{"roles_", "tokens_", "credentials_"}
+
+// ReservedUserName whether the keys of a user named name could collide with those of another user
+func ReservedUserName(name string) bool {
+	return hasAnyPrefix(name, userKeyPrefixes)
+}
+
 // Role role
 type Role struct {
 	RoleName   string `json:"role_name,omitempty"`
@@ -73,11 +257,276 @@ func (r *Role) Key() string {
 	return "role_" + r.RoleName
 }
 
-// Token token
-type Token struct {
-	UserName  string `json:"user_name,omitempty"`
-	Password  []byte `json:"password,omitempty"`
-	Rand      string `json:"rand,omitempty"`
-	Timestamp int64  `json:"ts,omitempty"`
-	Expire    int64  `json:"expire,omitempty"`
+// UsersKey for searching all users bound to the role
+func (r *Role) UsersKey() string {
+	return "role_users_" + r.RoleName
+}
+
+// ChildrenKey for searching the roles implied by the role
+func (r *Role) ChildrenKey() string {
+	return "role_children_" + r.RoleName
+}
+
+// PermissionsKey for searching the permissions granted to the role
+func (r *Role) PermissionsKey() string {
+	return "role_permissions_" + r.RoleName
+}
+
+// ParentsKey for searching the roles implying the role
+func (r *Role) ParentsKey() string {
+	return "role_parents_" + r.RoleName
+}
+
+// roleKeyPrefixes role names starting with one of these would share keys with another role
+var roleKeyPrefixes = []string{"users_", "children_", "permissions_", "parents_"}
+
+// ReservedRoleName whether the keys of a role named name could collide with those of another role
+func ReservedRoleName(name string) bool {
+	return hasAnyPrefix(name, roleKeyPrefixes)
+}
+
+// hasAnyPrefix whether s starts with one of prefixes
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Binding role bound to user, stored at the user-role key
+type Binding struct {
+	UserName   string `json:"user_name,omitempty"`
+	RoleName   string `json:"role_name,omitempty"`
+	Resource   string `json:"resource,omitempty"`
+	NotBefore  int64  `json:"not_before,omitempty"`
+	ExpireAt   int64  `json:"expire_at,omitempty"`
+	CreateTime int64  `json:"create_time,omitempty"`
+}
+
+// Active whether the binding counts at unix time now
+func (b *Binding) Active(now int64) bool {
+	return now >= b.NotBefore && (b.ExpireAt == 0 || now < b.ExpireAt)
+}
+
+// Claims token claims, RFC 7519
+type Claims struct {
+	Sub   string   `json:"sub"`
+	Iat   int64    `json:"iat"`
+	Exp   int64    `json:"exp"`
+	Jti   string   `json:"jti"`
+	Sid   string   `json:"sid,omitempty"`
+	Cv    int64    `json:"cv,omitempty"`
+	Roles []string `json:"roles,omitempty"`
+}
+
+// Key for searching
+func (c *Claims) Key() string {
+	return "token_" + c.Jti
+}
+
+// RefreshToken refresh token, single-use
+type RefreshToken struct {
+	Token      string `json:"token,omitempty"`
+	UserName   string `json:"user_name,omitempty"`
+	FamilyID   string `json:"family_id,omitempty"`
+	Used       bool   `json:"used,omitempty"`
+	CreateTime int64  `json:"create_time,omitempty"`
+	Expire     int64  `json:"expire,omitempty"`
+}
+
+// Key for searching
+func (rt *RefreshToken) Key() string {
+	return "refresh_" + rt.Token
+}
+
+// TokenFamily tokens issued from one authentication through refresh token rotation, a login session
+type TokenFamily struct {
+	ID         string   `json:"id,omitempty"`
+	UserName   string   `json:"user_name,omitempty"`
+	Keys       []string `json:"keys,omitempty"`
+	CreateTime int64    `json:"create_time,omitempty"`
+	// TokenID, IssueTime and ExpireTime of the latest tokens issued
+	TokenID    string `json:"token_id,omitempty"`
+	IssueTime  int64  `json:"issue_time,omitempty"`
+	ExpireTime int64  `json:"expire_time,omitempty"`
+	// ClientIP and UserAgent of the latest authentication or refresh
+	ClientIP  string `json:"client_ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// Key for searching
+func (f *TokenFamily) Key() string {
+	return "family_" + f.ID
+}
+
+// LockoutReq unlock a user or a client IP
+type LockoutReq struct {
+	UserName string `json:"user_name,omitempty"`
+	ClientIP string `json:"client_ip,omitempty"`
+}
+
+// IntrospectReq token introspection request of RFC 7662, the client authenticates with HTTP basic auth
+type IntrospectReq struct {
+	ClientID      string `json:"-" form:"-"`
+	ClientSecret  string `json:"-" form:"-"`
+	Token         string `json:"token,omitempty" form:"token"`
+	TokenTypeHint string `json:"token_type_hint,omitempty" form:"token_type_hint"`
+}
+
+// IntrospectRsp token introspection response of RFC 7662, only active is set for inactive tokens
+type IntrospectRsp struct {
+	Code      int      `json:"code"`
+	Msg       string   `json:"msg"`
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	Exp       int64    `json:"exp,omitempty"`
+	Iat       int64    `json:"iat,omitempty"`
+	Sub       string   `json:"sub,omitempty"`
+	Jti       string   `json:"jti,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+}
+
+// LoginFailures recent failed logins of a user or a client IP
+type LoginFailures struct {
+	// Subject user:<name> or ip:<addr>
+	Subject     string `json:"subject,omitempty"`
+	Count       int    `json:"count,omitempty"`
+	LockedUntil int64  `json:"locked_until,omitempty"`
+}
+
+// Key for searching
+func (l *LoginFailures) Key() string {
+	return "lockout_" + l.Subject
+}
+
+// ResetCode outstanding password reset code of a user, only its hash is kept
+type ResetCode struct {
+	UserName   string `json:"user_name,omitempty"`
+	Hash       []byte `json:"hash,omitempty"`
+	Attempts   int    `json:"attempts,omitempty"`
+	CreateTime int64  `json:"create_time,omitempty"`
+}
+
+// Key for searching
+func (r *ResetCode) Key() string {
+	return "reset_" + r.UserName
+}
+
+// WebAuthnReq WebAuthn ceremony request, the binary fields are base64url encoded as the browser returns them
+type WebAuthnReq struct {
+	Token             string `json:"token,omitempty"`
+	UserName          string `json:"user_name,omitempty"`
+	ID                string `json:"id,omitempty"`
+	ClientDataJSON    string `json:"client_data_json,omitempty"`
+	AttestationObject string `json:"attestation_object,omitempty"`
+	AuthenticatorData string `json:"authenticator_data,omitempty"`
+	Signature         string `json:"signature,omitempty"`
+	UserHandle        string `json:"user_handle,omitempty"`
+	ClientIP          string `json:"-"`
+	UserAgent         string `json:"-"`
+}
+
+// WebAuthnRsp WebAuthn ceremony response
+type WebAuthnRsp struct {
+	Code    int               `json:"code"`
+	Msg     string            `json:"msg"`
+	Options *PublicKeyOptions `json:"options,omitempty"`
+	ID      string            `json:"id,omitempty"`
+}
+
+// PublicKeyOptions options of navigator.credentials.create or get, named as in the WebAuthn API
+type PublicKeyOptions struct {
+	Challenge          string             `json:"challenge"`
+	RP                 *RelyingParty      `json:"rp,omitempty"`
+	RPID               string             `json:"rpId,omitempty"`
+	User               *WebAuthnUser      `json:"user,omitempty"`
+	PubKeyCredParams   []*CredentialParam `json:"pubKeyCredParams,omitempty"`
+	AllowCredentials   []*CredentialDesc  `json:"allowCredentials,omitempty"`
+	ExcludeCredentials []*CredentialDesc  `json:"excludeCredentials,omitempty"`
+	Timeout            int64              `json:"timeout"`
+	Attestation        string             `json:"attestation,omitempty"`
+	UserVerification   string             `json:"userVerification,omitempty"`
+}
+
+// RelyingParty WebAuthn relying party
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// WebAuthnUser user entity of a registration, ID is the base64url user handle
+type WebAuthnUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// CredentialParam credential type and COSE algorithm accepted
+type CredentialParam struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+// CredentialDesc credential known for the user, ID base64url
+type CredentialDesc struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// WebAuthnChallenge registration or login ceremony waiting for the authenticator response
+type WebAuthnChallenge struct {
+	// Challenge base64url
+	Challenge string `json:"challenge,omitempty"`
+	// Type webauthn.create or webauthn.get, as in the client data
+	Type string `json:"type,omitempty"`
+	// UserName registering user, or the user logging in, empty for discoverable credentials
+	UserName   string `json:"user_name,omitempty"`
+	CreateTime int64  `json:"create_time,omitempty"`
+}
+
+// Key for searching
+func (w *WebAuthnChallenge) Key() string {
+	return "webauthn_" + w.Challenge
+}
+
+// WebAuthnCredential registered public key credential
+type WebAuthnCredential struct {
+	// ID base64url credential id
+	ID       string `json:"id,omitempty"`
+	UserName string `json:"user_name,omitempty"`
+	// PublicKey COSE_Key, RFC 9053
+	PublicKey []byte `json:"public_key,omitempty"`
+	Alg       int64  `json:"alg,omitempty"`
+	// SignCount last signature counter, a lower or equal one reveals a cloned authenticator
+	SignCount  uint32 `json:"sign_count,omitempty"`
+	AAGUID     []byte `json:"aaguid,omitempty"`
+	Format     string `json:"format,omitempty"`
+	CreateTime int64  `json:"create_time,omitempty"`
+}
+
+// Key for searching
+func (w *WebAuthnCredential) Key() string {
+	return "credential_" + w.ID
+}
+
+// JWK JSON Web Key, RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS JSON Web Key Set
+type JWKS struct {
+	Keys []*JWK `json:"keys"`
 }
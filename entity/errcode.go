@@ -1,14 +1,31 @@
 package entity
 
 const (
-	ErrCodeInvalidParam    = 1001
-	ErrCodeInvalidToken    = 1002
-	ErrCodeExpiredToken    = 1003
-	ErrCodeInvalidPassword = 1004
-	ErrCodeUserExists      = 2001
-	ErrCodeUserNotExist    = 2002
-	ErrCodeRoleExists      = 2003
-	ErrCodeRoleNotExist    = 2004
-	ErrCodeRoleNotMatch    = 2005
-	ErrCodeGenToken        = 3001
+	ErrCodeInvalidParam      = 1001
+	ErrCodeInvalidToken      = 1002
+	ErrCodeExpiredToken      = 1003
+	ErrCodeInvalidPassword   = 1004
+	ErrCodeReusedToken       = 1005
+	ErrCodePermissionDenied  = 1006
+	ErrCodeInvalidResetCode  = 1007
+	ErrCodeInvalidOTP        = 1008
+	ErrCodeInvalidCredential = 1009
+	ErrCodeAccountLocked     = 1010
+	ErrCodeRateLimited       = 1011
+	ErrCodeWeakPassword      = 1012
+	ErrCodeInvalidClient     = 1013
+	ErrCodeUserExists        = 2001
+	ErrCodeUserNotExist      = 2002
+	ErrCodeRoleExists        = 2003
+	ErrCodeRoleNotExist      = 2004
+	ErrCodeRoleNotMatch      = 2005
+	ErrCodeRoleCycle         = 2006
+	ErrCodeSessionNotExist   = 2007
+	ErrCodeMFAConflict       = 2008
+	ErrCodeCredentialExists  = 2009
+	ErrCodeGenToken          = 3001
+	ErrCodeSnapshot          = 3002
+	ErrCodeRestore           = 3003
+	ErrCodeHashPassword      = 3004
+	ErrCodeNotify            = 3005
 )
@@ -2,18 +2,42 @@ package logic
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
+	"math/big"
 )
 
+// GenKey generate private key and public key for the signing algorithm,
+// both are the same random secret for HS256
+func GenKey(alg string) ([]byte, []byte, error) {
+	switch alg {
+	case AlgRS256:
+		return GenRsaKey()
+	case AlgES256:
+		return GenEcKey()
+	case AlgEdDSA:
+		return GenEdKey()
+	case AlgHS256:
+		secret := make([]byte, 32)
+		randBytes(secret)
+		return secret, secret, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported algorithm %s", alg)
+}
+
 // GenRsaKey generate private key and public key
 func GenRsaKey() ([]byte, []byte, error) {
 	// generate private key
-	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -38,6 +62,56 @@ func GenRsaKey() ([]byte, []byte, error) {
 	return priv, pub, nil
 }
 
+// GenEcKey generate P-256 private key and public key
+func GenEcKey() ([]byte, []byte, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	privStream, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	priv := pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: privStream,
+	})
+	pubStream, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pubStream,
+	})
+	return priv, pub, nil
+}
+
+// GenEdKey generate Ed25519 private key and public key
+func GenEdKey() ([]byte, []byte, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	privStream, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	priv := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privStream,
+	})
+	pubStream, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pubStream,
+	})
+	return priv, pub, nil
+}
+
 // RsaSign sign
 func RsaSign(data, privKey []byte) ([]byte, error) {
 	privateKey, err := decodePrivKey(privKey)
@@ -94,6 +168,107 @@ func RsaDec(ciphertext, privKey []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
+// EcSign sign with ES256, the signature is r||s as used by JWS
+func EcSign(data, privKey []byte) ([]byte, error) {
+	privateKey, err := decodeEcPrivKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, privateKey, hashData(data))
+	if err != nil {
+		return nil, err
+	}
+	sign := make([]byte, 64)
+	r.FillBytes(sign[:32])
+	s.FillBytes(sign[32:])
+	return sign, nil
+}
+
+// EcVerify verify ES256 sign
+func EcVerify(data, sign, pubKey []byte) error {
+	pub, err := decodePubKeyAny(pubKey)
+	if err != nil {
+		return err
+	}
+	publicKey, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("not ECDSA PublicKey type")
+	}
+	if len(sign) != 64 {
+		return errors.New("invalid signature length")
+	}
+	r := new(big.Int).SetBytes(sign[:32])
+	s := new(big.Int).SetBytes(sign[32:])
+	if !ecdsa.Verify(publicKey, hashData(data), r, s) {
+		return errors.New("ecdsa: verification error")
+	}
+	return nil
+}
+
+// EdSign sign with Ed25519
+func EdSign(data, privKey []byte) ([]byte, error) {
+	block, _ := pem.Decode(privKey)
+	if block == nil {
+		return nil, errors.New("invalid private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not Ed25519 PrivateKey type")
+	}
+	return ed25519.Sign(privateKey, data), nil
+}
+
+// EdVerify verify Ed25519 sign
+func EdVerify(data, sign, pubKey []byte) error {
+	pub, err := decodePubKeyAny(pubKey)
+	if err != nil {
+		return err
+	}
+	publicKey, ok := pub.(ed25519.PublicKey)
+	if !ok {
+		return errors.New("not Ed25519 PublicKey type")
+	}
+	if !ed25519.Verify(publicKey, data, sign) {
+		return errors.New("ed25519: verification error")
+	}
+	return nil
+}
+
+// HmacSign sign with HMAC-SHA256
+func HmacSign(data, secret []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// HmacVerify verify HMAC-SHA256 sign
+func HmacVerify(data, sign, secret []byte) error {
+	if !hmac.Equal(HmacSign(data, secret), sign) {
+		return errors.New("hmac: verification error")
+	}
+	return nil
+}
+
+func decodePubKeyAny(pubKey []byte) (interface{}, error) {
+	block, _ := pem.Decode(pubKey)
+	if block == nil {
+		return nil, errors.New("invalid public key")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func decodeEcPrivKey(privKey []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(privKey)
+	if block == nil {
+		return nil, errors.New("invalid private key")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
 func decodePubKey(pubKey []byte) (*rsa.PublicKey, error) {
 	block, _ := pem.Decode(pubKey)
 	if block == nil {
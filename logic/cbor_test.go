@@ -0,0 +1,129 @@
+package logic
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// cborEncode encode what cborDecode supports, map keys in unspecified order
+func cborEncode(v interface{}) []byte {
+	switch x := v.(type) {
+	case nil:
+		return []byte{0xf6}
+	case bool:
+		if x {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case int:
+		return cborEncode(int64(x))
+	case int64:
+		if x < 0 {
+			return cborHead(cborNegInt, uint64(-1-x))
+		}
+		return cborHead(cborUint, uint64(x))
+	case []byte:
+		return append(cborHead(cborBytes, uint64(len(x))), x...)
+	case string:
+		return append(cborHead(cborText, uint64(len(x))), x...)
+	case []interface{}:
+		data := cborHead(cborArray, uint64(len(x)))
+		for _, item := range x {
+			data = append(data, cborEncode(item)...)
+		}
+		return data
+	case map[interface{}]interface{}:
+		data := cborHead(cborMap, uint64(len(x)))
+		for k, item := range x {
+			data = append(data, cborEncode(k)...)
+			data = append(data, cborEncode(item)...)
+		}
+		return data
+	}
+	panic("cbor: unsupported type")
+}
+
+func cborHead(major byte, n uint64) []byte {
+	if n < 24 {
+		return []byte{major<<5 | byte(n)}
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, n)
+	switch {
+	case n <= 0xff:
+		return append([]byte{major<<5 | 24}, buf[7:]...)
+	case n <= 0xffff:
+		return append([]byte{major<<5 | 25}, buf[6:]...)
+	case n <= 0xffffffff:
+		return append([]byte{major<<5 | 26}, buf[4:]...)
+	}
+	return append([]byte{major<<5 | 27}, buf...)
+}
+
+// Test_cborDecode RFC 8949 appendix A
+func Test_cborDecode(t *testing.T) {
+	tests := []struct {
+		hex  string
+		want interface{}
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3903e7", int64(-1000)},
+		{"40", []byte{}},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"6449455446", "IETF"},
+		{"80", []interface{}{}},
+		{"83010203", []interface{}{int64(1), int64(2), int64(3)}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hex, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.hex)
+			got, rest, err := cborDecode(data)
+			assert.Nil(t, err)
+			assert.Empty(t, rest)
+			assert.Equal(t, tt.want, got)
+			again, _, err := cborDecode(cborEncode(got))
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, again)
+		})
+	}
+
+	// the bytes following the item are returned
+	_, rest, err := cborDecode([]byte{0x00, 0x01})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x01}, rest)
+
+	nested := make([]byte, 20)
+	for i := range nested {
+		nested[i] = 0x81
+	}
+	for _, bad := range []string{
+		"",
+		"9f01ff",             // indefinite length
+		"1bffffffffffffffff", // overflow
+		"6261",               // truncated text
+		"9affffffff",         // huge array
+		"c074",               // tag
+		"f93c00",             // float
+		"a14001",             // byte string key
+		"a201020103",         // duplicate key
+		hex.EncodeToString(append(nested, 0x00)),
+	} {
+		data, _ := hex.DecodeString(bad)
+		_, _, err := cborDecode(data)
+		assert.NotNil(t, err, bad)
+	}
+}
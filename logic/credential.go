@@ -0,0 +1,165 @@
+package logic
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"time"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/carterdings/authentication/repo/log"
+	"github.com/patrickmn/go-cache"
+)
+
+// ChangePassword change the password of the token user, who proves the current one.
+// Every session of the user is revoked.
+func (s *service) ChangePassword(req *entity.PasswordReq) error {
+	ureq := &entity.UserRoleReq{
+		UserName: req.UserName,
+		Token:    req.Token,
+	}
+	_, err := s.checkToken(ureq)
+	if err != nil {
+		return err
+	}
+	// wrong current passwords count as failed logins, a stolen token does not allow guessing
+	err = s.reserveAttempt(ureq.UserName, req.ClientIP)
+	if err != nil {
+		return err
+	}
+	_, err = s.verifyUser(ureq.UserName, req.Password)
+	if err != nil {
+		return err
+	}
+	s.releaseAttempt(ureq.UserName, req.ClientIP)
+	return s.setPassword(ureq.UserName, req.NewPassword)
+}
+
+// ResetPassword set the password of a user without the current one, for admins.
+// Every session of the user is revoked.
+func (s *service) ResetPassword(req *entity.PasswordReq) error {
+	return s.setPassword(req.UserName, req.NewPassword)
+}
+
+// ForgotPassword deliver a single-use reset code to the user through the notifier, it replaces
+// any previous code. Unknown users get no code and no error, so that names cannot be probed.
+func (s *service) ForgotPassword(req *entity.PasswordReq) error {
+	_, ok := dao.Get((&entity.User{UserName: req.UserName}).Key())
+	if !ok {
+		log.Errorf("Reset code requested for unknown user %s", req.UserName)
+		return nil
+	}
+	code := randString(18)
+	rc := &entity.ResetCode{
+		UserName:   req.UserName,
+		Hash:       hashData([]byte(code)),
+		CreateTime: time.Now().Unix(),
+	}
+	s.resetLock.Lock()
+	dao.Set(rc.Key(), rc, time.Duration(entity.ResetCodeExpire)*time.Second)
+	s.resetLock.Unlock()
+	err := s.notifier.Notify(req.UserName, "Password reset",
+		fmt.Sprintf("Your password reset code is %s, valid for %d minutes.", code, entity.ResetCodeExpire/60))
+	if err != nil {
+		log.Errorf("Notify reset code to %s: %v", req.UserName, err)
+		return errs.Newf(entity.ErrCodeNotify, "notify: %v", err)
+	}
+	return nil
+}
+
+// ConfirmReset set the new password with a reset code, the code is consumed and every session revoked
+func (s *service) ConfirmReset(req *entity.PasswordReq) error {
+	if req.NewPassword == "" {
+		return errs.New(entity.ErrCodeInvalidParam, "Empty password")
+	}
+	rc := &entity.ResetCode{
+		UserName: req.UserName,
+	}
+	s.resetLock.Lock()
+	defer s.resetLock.Unlock()
+	v, ok := dao.Get(rc.Key())
+	if ok {
+		rc, ok = v.(*entity.ResetCode)
+	}
+	if !ok {
+		return errs.New(entity.ErrCodeInvalidResetCode, "Invalid reset code")
+	}
+	if subtle.ConstantTimeCompare(hashData([]byte(req.Code)), rc.Hash) != 1 {
+		// a few guesses only
+		failed := *rc
+		failed.Attempts++
+		remain := failed.CreateTime + entity.ResetCodeExpire - time.Now().Unix()
+		if failed.Attempts >= entity.ResetCodeAttempts || remain <= 0 {
+			dao.Delete(rc.Key())
+		} else {
+			dao.Set(failed.Key(), &failed, time.Duration(remain)*time.Second)
+		}
+		log.Errorf("Invalid reset code for %s", req.UserName)
+		return errs.New(entity.ErrCodeInvalidResetCode, "Invalid reset code")
+	}
+	err := s.setPassword(req.UserName, req.NewPassword)
+	if err != nil {
+		return err
+	}
+	dao.Delete(rc.Key())
+	return nil
+}
+
+// setPassword check password against the policy and store it freshly salted and hashed,
+// bump the credential version and revoke all tokens
+func (s *service) setPassword(userName, password string) error {
+	if password == "" {
+		return errs.New(entity.ErrCodeInvalidParam, "Empty password")
+	}
+	if err := s.policy.Check(userName, password); err != nil {
+		return err
+	}
+	if err := s.checkHistory(userName, password); err != nil {
+		return err
+	}
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		return errs.Newf(entity.ErrCodeHashPassword, "hash password: %v", err)
+	}
+	_, err = s.updateUser(userName, func(usr *entity.User) error {
+		usr.PasswordHistory = s.passwordHistory(usr)
+		usr.PasswordHash = hash
+		usr.Salt = nil
+		usr.Password = nil
+		usr.CredVersion++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// tokens issued meanwhile carry the old version and are rejected anyway
+	s.revokeUserTokens(userName)
+	log.Infof("Password of %s changed", userName)
+	return nil
+}
+
+// updateUser apply update to a copy of the user record and store it, nothing is stored if update fails
+func (s *service) updateUser(userName string, update func(usr *entity.User) error) (*entity.User, error) {
+	user := &entity.User{
+		UserName: userName,
+	}
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+	u, ok := dao.Get(user.Key())
+	if !ok {
+		log.Errorf("User %s not exist", user.Key())
+		return nil, errs.New(entity.ErrCodeUserNotExist, "User not exist")
+	}
+	usr, ok := u.(*entity.User)
+	if !ok {
+		return nil, errs.New(entity.ErrCodeUserNotExist, "User not exist")
+	}
+	changed := *usr
+	err := update(&changed)
+	if err != nil {
+		return nil, err
+	}
+	dao.Set(changed.Key(), &changed, cache.NoExpiration)
+	return &changed, nil
+}
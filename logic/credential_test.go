@@ -0,0 +1,169 @@
+package logic
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_AuthService_ChangePassword ...
+func Test_AuthService_ChangePassword(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s := NewServie(privKey, pubKey)
+
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "changer", Password: "old"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "changer"})
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "changer", Password: "old"})
+	assert.Nil(t, err)
+	token := rsp.Token
+	other, err := s.Authenticate(&entity.UserRoleReq{UserName: "changer", Password: "old"})
+	assert.Nil(t, err)
+	u, _ := dao.Get("user_changer")
+	oldHash := u.(*entity.User).PasswordHash
+
+	tests := []struct {
+		name string
+		req  *entity.PasswordReq
+		err  error
+	}{
+		{"test_no_token", &entity.PasswordReq{Password: "old", NewPassword: "new"}, errs.New(entity.ErrCodeInvalidToken, "Invalid token: malformed")},
+		{"test_wrong_password", &entity.PasswordReq{Token: token, Password: "bad", NewPassword: "new"}, errs.New(entity.ErrCodeInvalidPassword, "Invalid password")},
+		{"test_empty", &entity.PasswordReq{Token: token, Password: "old"}, errs.New(entity.ErrCodeInvalidParam, "Empty password")},
+		{"test_change", &entity.PasswordReq{Token: token, Password: "old", NewPassword: "new"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.ChangePassword(tt.req)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+
+	u, _ = dao.Get("user_changer")
+	usr := u.(*entity.User)
+	assert.Equal(t, int64(1), usr.CredVersion)
+	assert.NotEqual(t, oldHash, usr.PasswordHash)
+	// every session ends
+	_, err = s.AllRoles(&entity.UserRoleReq{Token: other.Token})
+	assert.NotNil(t, err)
+	_, err = s.Refresh(&entity.UserRoleReq{RefreshToken: other.RefreshToken})
+	assert.NotNil(t, err)
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "changer", Password: "old"})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidPassword, "Invalid password"), err)
+	rsp, err = s.Authenticate(&entity.UserRoleReq{UserName: "changer", Password: "new"})
+	assert.Nil(t, err)
+	_, err = s.AllRoles(&entity.UserRoleReq{Token: rsp.Token})
+	assert.Nil(t, err)
+}
+
+// Test_AuthService_ResetPassword ...
+func Test_AuthService_ResetPassword(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s := NewServie(privKey, pubKey)
+
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "forgetful", Password: "old"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "forgetful"})
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "forgetful", Password: "old"})
+	assert.Nil(t, err)
+	claims, err := parseToken(rsp.Token, s.(*service).keys)
+	assert.Nil(t, err)
+
+	err = s.ResetPassword(&entity.PasswordReq{UserName: "nobody", NewPassword: "new"})
+	assert.Equal(t, errs.New(entity.ErrCodeUserNotExist, "User not exist"), err)
+	assert.Nil(t, s.ResetPassword(&entity.PasswordReq{UserName: "forgetful", NewPassword: "new"}))
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "forgetful", Password: "new"})
+	assert.Nil(t, err)
+
+	// a token of the previous credentials is rejected even if still stored
+	dao.Set(claims.Key(), claims, 0)
+	defer dao.Delete(claims.Key())
+	_, err = s.AllRoles(&entity.UserRoleReq{Token: rsp.Token})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidToken, "Invalid token: credentials changed"), err)
+}
+
+// memNotifier keep the last message of each user
+type memNotifier struct {
+	messages map[string]string
+}
+
+func (n *memNotifier) Notify(userName, subject, message string) error {
+	n.messages[userName] = message
+	return nil
+}
+
+// code reset code in the last message of the user
+func (n *memNotifier) code(userName string) string {
+	fields := strings.Fields(n.messages[userName])
+	for i, f := range fields {
+		if f == "is" && i+1 < len(fields) {
+			return strings.TrimSuffix(fields[i+1], ",")
+		}
+	}
+	return ""
+}
+
+// Test_AuthService_ForgotPassword ...
+func Test_AuthService_ForgotPassword(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	notifier := &memNotifier{messages: make(map[string]string)}
+	s, err := NewServiceWithConfig(&Config{PrivKey: privKey, PubKey: pubKey, Notifier: notifier})
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "forgot", Password: "old"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "forgot"})
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "forgot", Password: "old"})
+	assert.Nil(t, err)
+
+	// unknown users are not told apart
+	assert.Nil(t, s.ForgotPassword(&entity.PasswordReq{UserName: "nobody"}))
+	assert.Empty(t, notifier.messages["nobody"])
+
+	assert.Nil(t, s.ForgotPassword(&entity.PasswordReq{UserName: "forgot"}))
+	first := notifier.code("forgot")
+	assert.NotEmpty(t, first)
+	// a new code replaces the previous one
+	assert.Nil(t, s.ForgotPassword(&entity.PasswordReq{UserName: "forgot"}))
+	code := notifier.code("forgot")
+	assert.NotEqual(t, first, code)
+	v, _ := dao.Get("reset_forgot")
+	// only the hash is stored
+	assert.Equal(t, hashData([]byte(code)), v.(*entity.ResetCode).Hash)
+
+	tests := []struct {
+		name string
+		req  *entity.PasswordReq
+		err  error
+	}{
+		{"test_replaced", &entity.PasswordReq{UserName: "forgot", Code: first, NewPassword: "new"}, errs.New(entity.ErrCodeInvalidResetCode, "Invalid reset code")},
+		{"test_empty", &entity.PasswordReq{UserName: "forgot", Code: code}, errs.New(entity.ErrCodeInvalidParam, "Empty password")},
+		{"test_other_user", &entity.PasswordReq{UserName: "nobody", Code: code, NewPassword: "new"}, errs.New(entity.ErrCodeInvalidResetCode, "Invalid reset code")},
+		{"test_confirm", &entity.PasswordReq{UserName: "forgot", Code: code, NewPassword: "new"}, nil},
+		{"test_single_use", &entity.PasswordReq{UserName: "forgot", Code: code, NewPassword: "newer"}, errs.New(entity.ErrCodeInvalidResetCode, "Invalid reset code")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.ConfirmReset(tt.req)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+	_, err = s.AllRoles(&entity.UserRoleReq{Token: rsp.Token})
+	assert.NotNil(t, err)
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "forgot", Password: "new"})
+	assert.Nil(t, err)
+
+	// guessing drops the code
+	assert.Nil(t, s.ForgotPassword(&entity.PasswordReq{UserName: "forgot"}))
+	code = notifier.code("forgot")
+	for i := 0; i < entity.ResetCodeAttempts; i++ {
+		err = s.ConfirmReset(&entity.PasswordReq{UserName: "forgot", Code: "guess", NewPassword: "pwned"})
+		assert.Equal(t, entity.ErrCodeInvalidResetCode, errs.ErrCode(err))
+	}
+	err = s.ConfirmReset(&entity.PasswordReq{UserName: "forgot", Code: code, NewPassword: "pwned"})
+	assert.Equal(t, entity.ErrCodeInvalidResetCode, errs.ErrCode(err))
+}
@@ -0,0 +1,139 @@
+package logic
+
+import (
+	"sort"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/carterdings/authentication/repo/log"
+)
+
+// AddRoleChild make the role imply the child role, users bound to the role hold the child role as well
+func (s *service) AddRoleChild(req *entity.RoleReq) error {
+	parent := &entity.Role{
+		RoleName: req.RoleName,
+	}
+	child := &entity.Role{
+		RoleName: req.ChildRole,
+	}
+	// edges change under the role lock so that a concurrent delete cannot leave a dangling edge
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+	err := checkRoles(parent, child)
+	if err != nil {
+		return err
+	}
+	// the parent must not be implied by the child already
+	if implies(child.RoleName, parent.RoleName) {
+		log.Errorf("Role %s implied by %s", parent.RoleName, child.RoleName)
+		return errs.Newf(entity.ErrCodeRoleCycle, "Role cycle: %s implied by %s", parent.RoleName, child.RoleName)
+	}
+	addToSet(parent.ChildrenKey(), child.RoleName)
+	addToSet(child.ParentsKey(), parent.RoleName)
+	return nil
+}
+
+// RemoveRoleChild drop the edge from the role to the child role
+func (s *service) RemoveRoleChild(req *entity.RoleReq) error {
+	parent := &entity.Role{
+		RoleName: req.RoleName,
+	}
+	child := &entity.Role{
+		RoleName: req.ChildRole,
+	}
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+	err := checkRoles(parent, child)
+	if err != nil {
+		return err
+	}
+	removeFromSet(parent.ChildrenKey(), child.RoleName)
+	removeFromSet(child.ParentsKey(), parent.RoleName)
+	return nil
+}
+
+// dropRoleEdges drop every edge from and to the role, called with the role lock held
+func dropRoleEdges(role *entity.Role) {
+	v, _ := dao.Get(role.ChildrenKey())
+	for child := range copySet(v) {
+		removeFromSet((&entity.Role{RoleName: child}).ParentsKey(), role.RoleName)
+	}
+	v, _ = dao.Get(role.ParentsKey())
+	for parent := range copySet(v) {
+		removeFromSet((&entity.Role{RoleName: parent}).ChildrenKey(), role.RoleName)
+	}
+	dao.Delete(role.ChildrenKey())
+	dao.Delete(role.ParentsKey())
+}
+
+func checkRoles(roles ...*entity.Role) error {
+	for _, role := range roles {
+		_, ok := dao.Get(role.Key())
+		if !ok {
+			// role not exist
+			log.Errorf("Role %s not exist", role.Key())
+			return errs.New(entity.ErrCodeRoleNotExist, "Role not exist")
+		}
+	}
+	return nil
+}
+
+// implies whether ancestor is roleName or implies it, directly or not
+func implies(ancestor, roleName string) bool {
+	for _, r := range effectiveRoles([]string{ancestor}) {
+		if r == roleName {
+			return true
+		}
+	}
+	return false
+}
+
+// effectiveRoles sorted roles and every role they imply, scoped entries imply roles in the same scope
+func effectiveRoles(roles []string) []string {
+	seen := make(map[string]bool)
+	queue := append([]string(nil), roles...)
+	for len(queue) > 0 {
+		entry := queue[0]
+		queue = queue[1:]
+		if seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		roleName, resource := splitScope(entry)
+		v, _ := dao.Get((&entity.Role{RoleName: roleName}).ChildrenKey())
+		children, _ := v.(map[string]bool)
+		for child := range children {
+			if e := joinScope(child, resource); !seen[e] {
+				queue = append(queue, e)
+			}
+		}
+	}
+	rlist := make([]string, 0, len(seen))
+	for k := range seen {
+		rlist = append(rlist, k)
+	}
+	sort.Strings(rlist)
+	return rlist
+}
+
+// hasRole whether the user is bound to the role, or to a role implying it, globally or
+// in a scope applying to resource
+func hasRole(userName, roleName, resource string) bool {
+	for _, scope := range resourceScopes(resource) {
+		bind := &entity.UserRoleReq{
+			UserName: userName,
+			RoleName: roleName,
+			Resource: scope,
+		}
+		if bindActive(bind) {
+			return true
+		}
+	}
+	for _, r := range effectiveRoles(applicableRoles(userName, resource)) {
+		if r == roleName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package logic
+
+import (
+	"testing"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_AuthService_RoleHierarchy ...
+func Test_AuthService_RoleHierarchy(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s := NewServie(privKey, pubKey)
+
+	for _, r := range []string{"h_admin", "h_editor", "h_viewer"} {
+		assert.Nil(t, s.CreateRole(&entity.RoleReq{RoleName: r}))
+		defer s.DeleteRole(&entity.RoleReq{RoleName: r})
+	}
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "hierarchy", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "hierarchy"})
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "hierarchy", RoleName: "h_admin"}))
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "hierarchy", Password: "pwd"})
+	assert.Nil(t, err)
+	token := rsp.Token
+
+	edges := []struct {
+		name string
+		req  *entity.RoleReq
+		err  error
+	}{
+		{"test_1", &entity.RoleReq{RoleName: "h_admin", ChildRole: "h_editor"}, nil},
+		{"test_2", &entity.RoleReq{RoleName: "h_editor", ChildRole: "h_viewer"}, nil},
+		{"test_3", &entity.RoleReq{RoleName: "h_viewer", ChildRole: "h_admin"}, errs.New(entity.ErrCodeRoleCycle, "Role cycle: h_viewer implied by h_admin")},
+		{"test_4", &entity.RoleReq{RoleName: "h_viewer", ChildRole: "h_viewer"}, errs.New(entity.ErrCodeRoleCycle, "Role cycle: h_viewer implied by h_viewer")},
+		{"test_5", &entity.RoleReq{RoleName: "h_admin", ChildRole: "h_unknown"}, errs.New(entity.ErrCodeRoleNotExist, "Role not exist")},
+	}
+	for _, tt := range edges {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.AddRoleChild(tt.req)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+
+	checks := []struct {
+		name   string
+		role   string
+		result bool
+	}{
+		{"test_direct", "h_admin", true},
+		{"test_child", "h_editor", true},
+		{"test_grandchild", "h_viewer", true},
+		{"test_unbound", "h_unknown", false},
+	}
+	for _, tt := range checks {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp, err := s.CheckRole(&entity.UserRoleReq{RoleName: tt.role, Token: token})
+			assert.Nil(t, err)
+			assert.Equal(t, tt.result, rsp.CheckResult)
+		})
+	}
+
+	rsp, err = s.AllRoles(&entity.UserRoleReq{Token: token})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"h_admin"}, rsp.Roles)
+	rsp, err = s.AllRoles(&entity.UserRoleReq{Token: token, Effective: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"h_admin", "h_editor", "h_viewer"}, rsp.Roles)
+
+	// removing an edge cuts off everything below it
+	assert.Nil(t, s.RemoveRoleChild(&entity.RoleReq{RoleName: "h_admin", ChildRole: "h_editor"}))
+	rsp, err = s.CheckRole(&entity.UserRoleReq{RoleName: "h_viewer", Token: token})
+	assert.Nil(t, err)
+	assert.False(t, rsp.CheckResult)
+	assert.Nil(t, s.AddRoleChild(&entity.RoleReq{RoleName: "h_admin", ChildRole: "h_editor"}))
+
+	// deleting a role detaches it from its parents and children
+	assert.Nil(t, s.DeleteRole(&entity.RoleReq{RoleName: "h_editor"}))
+	_, ok := dao.Get("role_children_h_admin")
+	assert.False(t, ok)
+	_, ok = dao.Get("role_parents_h_viewer")
+	assert.False(t, ok)
+	rsp, err = s.AllRoles(&entity.UserRoleReq{Token: token, Effective: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"h_admin"}, rsp.Roles)
+}
@@ -0,0 +1,116 @@
+package logic
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/carterdings/authentication/repo/log"
+)
+
+// access token formats
+const (
+	// TokenJWT signed JWT carrying the claims
+	TokenJWT = "jwt"
+	// TokenOpaque random reference to the claims kept in the store
+	TokenOpaque = "opaque"
+)
+
+// Introspect tell an authenticated client whether a token is active and whose it is, RFC 7662.
+// Roles and scope are those the user holds now, an inactive token tells nothing more.
+func (s *service) Introspect(req *entity.IntrospectReq) (*entity.IntrospectRsp, error) {
+	rsp := &entity.IntrospectRsp{}
+	if !s.checkClient(req.ClientID, req.ClientSecret) {
+		log.Errorf("Introspection by invalid client %s", req.ClientID)
+		return rsp, errs.New(entity.ErrCodeInvalidClient, "Invalid client")
+	}
+	if req.Token == "" {
+		return rsp, errs.New(entity.ErrCodeInvalidParam, "Empty token")
+	}
+	// refresh tokens are never active here, whatever the hint
+	claims, err := s.checkToken(&entity.UserRoleReq{Token: req.Token})
+	if err != nil {
+		return rsp, nil
+	}
+	roles := userRoles(claims.Sub)
+	rsp.Active = true
+	rsp.Scope = strings.Join(roles, " ")
+	rsp.Username = claims.Sub
+	rsp.TokenType = "Bearer"
+	rsp.Exp = claims.Exp
+	rsp.Iat = claims.Iat
+	rsp.Sub = claims.Sub
+	rsp.Jti = claims.Jti
+	rsp.Roles = roles
+	return rsp, nil
+}
+
+// LoadClients load the clients allowed to introspect tokens, one <client_id>:<secret> per line
+func LoadClients(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	clients := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s:%d: want <client_id>:<secret>", path, n)
+		}
+		clients[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read clients %s: %v", path, err)
+	}
+	return clients, nil
+}
+
+// checkClient whether the client credentials are those of a known client
+func (s *service) checkClient(clientID, secret string) bool {
+	want, ok := s.clients[clientID]
+	if !ok || clientID == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hashData([]byte(secret)), want) == 1
+}
+
+// tokenClaims claims of a JWT, or those kept for an opaque token once they are issued,
+// JWTs issued before switching to opaque tokens stay valid
+func (s *service) tokenClaims(token string) (*entity.Claims, error) {
+	if s.tokenFormat != TokenOpaque || strings.Count(token, ".") == 2 {
+		return parseToken(token, s.keys)
+	}
+	if token == "" {
+		return nil, errs.New(entity.ErrCodeInvalidToken, "Invalid token: malformed")
+	}
+	v, ok := dao.Get((&entity.Claims{Jti: opaqueID(token)}).Key())
+	if !ok {
+		return nil, errs.New(entity.ErrCodeInvalidToken, "Invalid token: unknown")
+	}
+	claims, ok := v.(*entity.Claims)
+	if !ok {
+		return nil, errs.New(entity.ErrCodeInvalidToken, "Invalid token: unknown")
+	}
+	if time.Now().Unix() >= claims.Exp {
+		return nil, errs.New(entity.ErrCodeExpiredToken, "Expired token")
+	}
+	return claims, nil
+}
+
+// opaqueID token id of an opaque token, the store keeps no token that can be presented
+func opaqueID(token string) string {
+	return base64.RawURLEncoding.EncodeToString(hashData([]byte(token)))
+}
@@ -0,0 +1,111 @@
+package logic
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_LoadClients ...
+func Test_LoadClients(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clients.txt")
+	assert.Nil(t, os.WriteFile(path, []byte("# introspecting services\nbilling:s3cret:with:colons\n\n reports:pwd \n"), 0600))
+	clients, err := LoadClients(path)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"billing": "s3cret:with:colons", "reports": "pwd"}, clients)
+
+	assert.Nil(t, os.WriteFile(path, []byte("billing:pwd\nreports\n"), 0600))
+	_, err = LoadClients(path)
+	assert.Equal(t, path+":2: want <client_id>:<secret>", err.Error())
+}
+
+// Test_AuthService_Introspect ...
+func Test_AuthService_Introspect(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	_, err = NewServiceWithConfig(&Config{PrivKey: privKey, PubKey: pubKey, TokenFormat: "paseto"})
+	assert.Equal(t, "unsupported token format paseto", err.Error())
+	clients := map[string]string{"billing": "s3cret"}
+	s, err := NewServiceWithConfig(&Config{PrivKey: privKey, PubKey: pubKey, TokenFormat: TokenOpaque, Clients: clients})
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "opaque", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "opaque"})
+	assert.Nil(t, s.CreateRole(&entity.RoleReq{RoleName: "opaque_reader"}))
+	defer s.DeleteRole(&entity.RoleReq{RoleName: "opaque_reader"})
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "opaque", RoleName: "opaque_reader"}))
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "opaque", Password: "pwd"})
+	assert.Nil(t, err)
+	token := rsp.Token
+	assert.False(t, strings.Contains(token, "."))
+	// the store keeps a hash of the token only
+	_, ok := dao.Get((&entity.Claims{Jti: token}).Key())
+	assert.False(t, ok)
+
+	// opaque tokens work everywhere a JWT does
+	roles, err := s.AllRoles(&entity.UserRoleReq{Token: token})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"opaque_reader"}, roles.Roles)
+	_, err = s.AllRoles(&entity.UserRoleReq{Token: token + "x"})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidToken, "Invalid token: unknown"), err)
+
+	tests := []struct {
+		name string
+		req  *entity.IntrospectReq
+		err  error
+	}{
+		{"test_no_client", &entity.IntrospectReq{Token: token},
+			errs.New(entity.ErrCodeInvalidClient, "Invalid client")},
+		{"test_bad_secret", &entity.IntrospectReq{ClientID: "billing", ClientSecret: "guess", Token: token},
+			errs.New(entity.ErrCodeInvalidClient, "Invalid client")},
+		{"test_unknown_client", &entity.IntrospectReq{ClientID: "reports", ClientSecret: "s3cret", Token: token},
+			errs.New(entity.ErrCodeInvalidClient, "Invalid client")},
+		{"test_empty_token", &entity.IntrospectReq{ClientID: "billing", ClientSecret: "s3cret"},
+			errs.New(entity.ErrCodeInvalidParam, "Empty token")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Introspect(tt.req)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+
+	introspect := func(token string) *entity.IntrospectRsp {
+		rsp, err := s.Introspect(&entity.IntrospectReq{ClientID: "billing", ClientSecret: "s3cret", Token: token})
+		assert.Nil(t, err)
+		return rsp
+	}
+	active := introspect(token)
+	assert.True(t, active.Active)
+	assert.Equal(t, "opaque", active.Sub)
+	assert.Equal(t, "opaque", active.Username)
+	assert.Equal(t, "Bearer", active.TokenType)
+	assert.Equal(t, "opaque_reader", active.Scope)
+	assert.Equal(t, []string{"opaque_reader"}, active.Roles)
+	assert.Equal(t, int64(entity.TokenExpire), active.Exp-active.Iat)
+
+	// refresh tokens and garbage are inactive and tell nothing
+	assert.Equal(t, &entity.IntrospectRsp{}, introspect(rsp.RefreshToken))
+	assert.Equal(t, &entity.IntrospectRsp{}, introspect("garbage"))
+	assert.Nil(t, s.Invalidate(&entity.UserRoleReq{Token: token}))
+	assert.Equal(t, &entity.IntrospectRsp{}, introspect(token))
+
+	// refreshed tokens are opaque as well
+	refreshed, err := s.Refresh(&entity.UserRoleReq{RefreshToken: rsp.RefreshToken})
+	assert.Nil(t, err)
+	assert.True(t, introspect(refreshed.Token).Active)
+
+	// JWTs are introspected too
+	s, err = NewServiceWithConfig(&Config{PrivKey: privKey, PubKey: pubKey, Clients: clients})
+	assert.Nil(t, err)
+	rsp, err = s.Authenticate(&entity.UserRoleReq{UserName: "opaque", Password: "pwd"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, strings.Count(rsp.Token, "."))
+	assert.True(t, introspect(rsp.Token).Active)
+}
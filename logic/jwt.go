@@ -0,0 +1,146 @@
+package logic
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/errs"
+)
+
+// signing algorithms, RFC 7518
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+	AlgHS256 = "HS256"
+)
+
+// Signer sign and verify the JWS signing input
+type Signer interface {
+	Alg() string
+	Sign(data []byte) ([]byte, error)
+	Verify(data, sign []byte) error
+}
+
+// NewSigner new signer for alg with PEM encoded keys, or the shared secret for HS256
+func NewSigner(alg string, privKey, pubKey []byte) (Signer, error) {
+	switch alg {
+	case AlgRS256:
+		return &rsaSigner{privKey, pubKey}, nil
+	case AlgES256:
+		return &ecSigner{privKey, pubKey}, nil
+	case AlgEdDSA:
+		return &edSigner{privKey, pubKey}, nil
+	case AlgHS256:
+		return &hmacSigner{privKey}, nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm %s", alg)
+}
+
+type rsaSigner struct {
+	privKey []byte
+	pubKey  []byte
+}
+
+func (s *rsaSigner) Alg() string                      { return AlgRS256 }
+func (s *rsaSigner) Sign(data []byte) ([]byte, error) { return RsaSign(data, s.privKey) }
+func (s *rsaSigner) Verify(data, sign []byte) error   { return RsaVerify(data, sign, s.pubKey) }
+
+type ecSigner struct {
+	privKey []byte
+	pubKey  []byte
+}
+
+func (s *ecSigner) Alg() string                      { return AlgES256 }
+func (s *ecSigner) Sign(data []byte) ([]byte, error) { return EcSign(data, s.privKey) }
+func (s *ecSigner) Verify(data, sign []byte) error   { return EcVerify(data, sign, s.pubKey) }
+
+type edSigner struct {
+	privKey []byte
+	pubKey  []byte
+}
+
+func (s *edSigner) Alg() string                      { return AlgEdDSA }
+func (s *edSigner) Sign(data []byte) ([]byte, error) { return EdSign(data, s.privKey) }
+func (s *edSigner) Verify(data, sign []byte) error   { return EdVerify(data, sign, s.pubKey) }
+
+type hmacSigner struct {
+	secret []byte
+}
+
+func (s *hmacSigner) Alg() string                      { return AlgHS256 }
+func (s *hmacSigner) Sign(data []byte) ([]byte, error) { return HmacSign(data, s.secret), nil }
+func (s *hmacSigner) Verify(data, sign []byte) error   { return HmacVerify(data, sign, s.secret) }
+
+// jwtHeader JOSE header
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// genToken encode and sign claims as a compact JWT with key
+func genToken(claims *entity.Claims, key *Key) (string, error) {
+	header, err := json.Marshal(&jwtHeader{Alg: key.Alg, Typ: "JWT", Kid: key.Kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sign, err := key.Signer.Sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sign), nil
+}
+
+// parseToken verify a compact JWT with the key of the ring it names and return its claims
+func parseToken(token string, keys *KeyRing) (*entity.Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errs.New(entity.ErrCodeInvalidToken, "Invalid token: malformed")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errs.Newf(entity.ErrCodeInvalidToken, "Invalid token: %v", err)
+	}
+	header := &jwtHeader{}
+	if err = json.Unmarshal(data, header); err != nil {
+		return nil, errs.Newf(entity.ErrCodeInvalidToken, "Invalid token: %v", err)
+	}
+	// never let the token pick the algorithm
+	if header.Alg != keys.Alg() {
+		return nil, errs.Newf(entity.ErrCodeInvalidToken, "Invalid token: unexpected alg %s", header.Alg)
+	}
+	key, ok := keys.Lookup(header.Kid)
+	if !ok {
+		return nil, errs.Newf(entity.ErrCodeInvalidToken, "Invalid token: unknown kid %s", header.Kid)
+	}
+	sign, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errs.Newf(entity.ErrCodeInvalidToken, "Invalid token: %v", err)
+	}
+	err = key.Signer.Verify([]byte(parts[0]+"."+parts[1]), sign)
+	if err != nil {
+		return nil, errs.Newf(entity.ErrCodeInvalidToken, "Invalid token: %v", err)
+	}
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errs.Newf(entity.ErrCodeInvalidToken, "Invalid token: %v", err)
+	}
+	claims := &entity.Claims{}
+	if err = json.Unmarshal(data, claims); err != nil {
+		return nil, errs.Newf(entity.ErrCodeInvalidToken, "Invalid token: %v", err)
+	}
+	if time.Now().Unix() >= claims.Exp {
+		return nil, errs.New(entity.ErrCodeExpiredToken, "Expired token")
+	}
+	return claims, nil
+}
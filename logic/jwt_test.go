@@ -0,0 +1,75 @@
+package logic
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_Signer ...
+func Test_Signer(t *testing.T) {
+	claims := &entity.Claims{
+		Sub: "cat",
+		Iat: time.Now().Unix(),
+		Exp: time.Now().Unix() + 7200,
+		Jti: "jti",
+	}
+
+	tests := []struct {
+		name string
+		alg  string
+	}{
+		{"test_rs256", AlgRS256},
+		{"test_es256", AlgES256},
+		{"test_eddsa", AlgEdDSA},
+		{"test_hs256", AlgHS256},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			privKey, pubKey, err := GenKey(tt.alg)
+			assert.Nil(t, err)
+			keys, err := NewStaticKeyRing(tt.alg, privKey, pubKey)
+			assert.Nil(t, err)
+
+			token, err := genToken(claims, keys.Active())
+			assert.Nil(t, err)
+			header, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+			assert.Equal(t, `{"alg":"`+tt.alg+`","typ":"JWT","kid":"`+keys.Active().Kid+`"}`, string(header))
+			got, err := parseToken(token, keys)
+			assert.Nil(t, err)
+			assert.Equal(t, claims, got)
+
+			// tampered claims
+			parts := strings.Split(token, ".")
+			forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"root","exp":9999999999}`))
+			_, err = parseToken(parts[0]+"."+forged+"."+parts[2], keys)
+			assert.Equal(t, entity.ErrCodeInvalidToken, errs.ErrCode(err))
+
+			// another key with the same kid
+			privKey, pubKey, err = GenKey(tt.alg)
+			assert.Nil(t, err)
+			other, _ := NewStaticKeyRing(tt.alg, privKey, pubKey)
+			other.keys[0].Kid = keys.Active().Kid
+			_, err = parseToken(token, other)
+			assert.Equal(t, entity.ErrCodeInvalidToken, errs.ErrCode(err))
+		})
+	}
+
+	// the token can not choose another algorithm
+	privKey, pubKey, _ := GenKey(AlgRS256)
+	rs, _ := NewStaticKeyRing(AlgRS256, privKey, pubKey)
+	hs, _ := NewStaticKeyRing(AlgHS256, pubKey, pubKey)
+	token, err := genToken(claims, hs.Active())
+	assert.Nil(t, err)
+	_, err = parseToken(token, rs)
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidToken, "Invalid token: unexpected alg HS256"), err)
+
+	_, err = NewSigner("none", nil, nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,389 @@
+package logic
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/log"
+)
+
+const (
+	keyFileExt    = ".pem"
+	secretPemType = "SECRET KEY"
+	// kidTimeLayout UTC creation time leading the kid of generated keys,
+	// the age of a key does not depend on the mtime of its file
+	kidTimeLayout = "20060102150405"
+)
+
+// Key signing key identified by kid
+type Key struct {
+	Kid        string
+	Alg        string
+	PrivKey    []byte
+	PubKey     []byte
+	Signer     Signer
+	CreateTime int64
+}
+
+// KeyRing signing keys, the newest one signs and the previous ones stay
+// available for verification until the tokens they signed have expired
+type KeyRing struct {
+	alg string
+	dir string
+
+	mu   sync.RWMutex
+	keys []*Key // newest first
+}
+
+// NewKeyRing load the keys of alg stored as <kid>.pem in dir, a key is generated
+// and persisted there if there is none. The keys are kept in memory only if dir is empty.
+// Keys retired for longer than a token lifetime are dropped on load.
+func NewKeyRing(alg, dir string) (*KeyRing, error) {
+	r := &KeyRing{
+		alg: alg,
+		dir: dir,
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		if err := r.load(); err != nil {
+			return nil, err
+		}
+	}
+	if len(r.keys) == 0 {
+		if err := r.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// NewStaticKeyRing key ring holding the single given key pair, never persisted
+func NewStaticKeyRing(alg string, privKey, pubKey []byte) (*KeyRing, error) {
+	key, err := newKey(alg, keyID(pubKey), privKey, pubKey, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return &KeyRing{
+		alg:  alg,
+		keys: []*Key{key},
+	}, nil
+}
+
+// Alg signing algorithm
+func (r *KeyRing) Alg() string {
+	return r.alg
+}
+
+// Active the key signing new tokens
+func (r *KeyRing) Active() *Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys[0]
+}
+
+// Lookup find a key still valid for verification
+func (r *KeyRing) Lookup(kid string) (*Key, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, k := range r.keys {
+		if k.Kid == kid {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// Keys active and previous keys, newest first
+func (r *KeyRing) Keys() []*Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*Key(nil), r.keys...)
+}
+
+// Rotate generate a new active key and drop the previous keys whose tokens have all expired
+func (r *KeyRing) Rotate() error {
+	privKey, pubKey, err := GenKey(r.alg)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	kid := now.UTC().Format(kidTimeLayout) + "-" + randString(4)
+	key, err := newKey(r.alg, kid, privKey, pubKey, now.Unix())
+	if err != nil {
+		return err
+	}
+	if r.dir != "" {
+		if err = writeKeyFile(r.keyPath(kid), r.alg, privKey); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	r.keys = append([]*Key{key}, r.keys...)
+	r.mu.Unlock()
+	log.Infof("Signing key rotated, active kid %s", kid)
+	r.prune()
+	return nil
+}
+
+// AutoRotate rotate the active key once it is older than interval, until stop is called
+func (r *KeyRing) AutoRotate(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	tick := time.Minute
+	if interval < tick {
+		tick = interval
+	}
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if time.Since(time.Unix(r.Active().CreateTime, 0)) < interval {
+					r.prune()
+					continue
+				}
+				if err := r.Rotate(); err != nil {
+					log.Errorf("Rotate signing key: %v", err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// JWKS public keys of the ring as a JSON Web Key Set, RFC 7517.
+// Symmetric HS256 secrets are never published.
+func (r *KeyRing) JWKS() *entity.JWKS {
+	jwks := &entity.JWKS{
+		Keys: []*entity.JWK{},
+	}
+	for _, k := range r.Keys() {
+		jwk, err := toJWK(k)
+		if err != nil {
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
+
+// prune drop the previous keys retired for longer than a token lifetime
+func (r *KeyRing) prune() {
+	now := time.Now().Unix()
+	r.mu.Lock()
+	keep := r.keys[:1]
+	var dropped []*Key
+	for i := 1; i < len(r.keys); i++ {
+		// a key is retired when the next one becomes active
+		retired := r.keys[i-1].CreateTime
+		if now-retired > entity.TokenExpire {
+			dropped = append(dropped, r.keys[i])
+			continue
+		}
+		keep = append(keep, r.keys[i])
+	}
+	r.keys = keep
+	r.mu.Unlock()
+
+	for _, k := range dropped {
+		log.Infof("Signing key %s expired", k.Kid)
+		if r.dir != "" {
+			os.Remove(r.keyPath(k.Kid))
+		}
+	}
+}
+
+func (r *KeyRing) load() error {
+	paths, err := filepath.Glob(filepath.Join(r.dir, "*"+keyFileExt))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), keyFileExt)
+		createTime, err := kidTime(kid)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		privKey := data
+		if r.alg == AlgHS256 {
+			block, _ := pem.Decode(data)
+			if block == nil || block.Type != secretPemType {
+				return fmt.Errorf("%s: invalid secret key", path)
+			}
+			privKey = block.Bytes
+		}
+		pubKey, err := publicKey(r.alg, privKey)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		key, err := newKey(r.alg, kid, privKey, pubKey, createTime)
+		if err != nil {
+			return err
+		}
+		r.keys = append(r.keys, key)
+	}
+	sort.SliceStable(r.keys, func(i, j int) bool {
+		return r.keys[i].CreateTime > r.keys[j].CreateTime
+	})
+	if len(r.keys) > 0 {
+		r.prune()
+	}
+	return nil
+}
+
+// kidTime creation time carried by a kid, <yyyymmddhhmmss>-<suffix>
+func kidTime(kid string) (int64, error) {
+	if len(kid) <= len(kidTimeLayout) || kid[len(kidTimeLayout)] != '-' {
+		return 0, fmt.Errorf("kid %s carries no creation time, want <yyyymmddhhmmss>-<suffix>", kid)
+	}
+	t, err := time.Parse(kidTimeLayout, kid[:len(kidTimeLayout)])
+	if err != nil {
+		return 0, fmt.Errorf("kid %s carries no creation time: %v", kid, err)
+	}
+	return t.Unix(), nil
+}
+
+func (r *KeyRing) keyPath(kid string) string {
+	return filepath.Join(r.dir, kid+keyFileExt)
+}
+
+func newKey(alg, kid string, privKey, pubKey []byte, createTime int64) (*Key, error) {
+	signer, err := NewSigner(alg, privKey, pubKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{
+		Kid:        kid,
+		Alg:        alg,
+		PrivKey:    privKey,
+		PubKey:     pubKey,
+		Signer:     signer,
+		CreateTime: createTime,
+	}, nil
+}
+
+// keyID stable key id derived from the public key
+func keyID(pubKey []byte) string {
+	return base64.RawURLEncoding.EncodeToString(hashData(pubKey)[:12])
+}
+
+func writeKeyFile(path, alg string, privKey []byte) error {
+	data := privKey
+	if alg == AlgHS256 {
+		data = pem.EncodeToMemory(&pem.Block{
+			Type:  secretPemType,
+			Bytes: privKey,
+		})
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// publicKey derive the PEM encoded public key from a private key
+func publicKey(alg string, privKey []byte) ([]byte, error) {
+	if alg == AlgHS256 {
+		return privKey, nil
+	}
+	block, _ := pem.Decode(privKey)
+	if block == nil {
+		return nil, errors.New("invalid private key")
+	}
+	var pub interface{}
+	switch alg {
+	case AlgRS256:
+		k, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub = &k.PublicKey
+	case AlgES256:
+		k, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub = &k.PublicKey
+	case AlgEdDSA:
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		edKey, ok := k.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("not Ed25519 PrivateKey type")
+		}
+		pub = edKey.Public()
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	pubStream, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pubStream,
+	}), nil
+}
+
+func toJWK(k *Key) (*entity.JWK, error) {
+	if k.Alg == AlgHS256 {
+		return nil, errors.New("symmetric key")
+	}
+	pub, err := decodePubKeyAny(k.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	jwk := &entity.JWK{
+		Kid: k.Kid,
+		Alg: k.Alg,
+		Use: "sig",
+	}
+	enc := base64.RawURLEncoding.EncodeToString
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = enc(p.N.Bytes())
+		jwk.E = enc(big.NewInt(int64(p.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.Kty = "EC"
+		jwk.Crv = p.Curve.Params().Name
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		p.X.FillBytes(x)
+		p.Y.FillBytes(y)
+		jwk.X = enc(x)
+		jwk.Y = enc(y)
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = enc(p)
+	default:
+		return nil, errors.New("unsupported public key")
+	}
+	return jwk, nil
+}
@@ -0,0 +1,102 @@
+package logic
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_KeyRing ...
+func Test_KeyRing(t *testing.T) {
+	tests := []struct {
+		name string
+		alg  string
+		kty  string
+	}{
+		{"test_rs256", AlgRS256, "RSA"},
+		{"test_es256", AlgES256, "EC"},
+		{"test_eddsa", AlgEdDSA, "OKP"},
+		{"test_hs256", AlgHS256, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			keys, err := NewKeyRing(tt.alg, dir)
+			assert.Nil(t, err)
+			active := keys.Active()
+			paths, _ := filepath.Glob(filepath.Join(dir, "*.pem"))
+			assert.Len(t, paths, 1)
+
+			claims := &entity.Claims{Sub: "cat", Exp: time.Now().Unix() + 60, Jti: "jti"}
+			token, err := genToken(claims, active)
+			assert.Nil(t, err)
+
+			// reload from the files after a restart
+			keys, err = NewKeyRing(tt.alg, dir)
+			assert.Nil(t, err)
+			assert.Equal(t, active.Kid, keys.Active().Kid)
+			_, err = parseToken(token, keys)
+			assert.Nil(t, err)
+
+			// the previous key still verifies after rotation
+			assert.Nil(t, keys.Rotate())
+			assert.NotEqual(t, active.Kid, keys.Active().Kid)
+			_, err = parseToken(token, keys)
+			assert.Nil(t, err)
+
+			jwks := keys.JWKS()
+			if tt.kty == "" {
+				assert.Empty(t, jwks.Keys)
+			} else {
+				assert.Len(t, jwks.Keys, 2)
+				assert.Equal(t, tt.kty, jwks.Keys[0].Kty)
+				assert.Equal(t, keys.Active().Kid, jwks.Keys[0].Kid)
+				assert.Equal(t, tt.alg, jwks.Keys[0].Alg)
+			}
+
+			// retired for longer than a token lifetime
+			keys.keys[0].CreateTime -= entity.TokenExpire + 1
+			keys.prune()
+			assert.Len(t, keys.Keys(), 1)
+			_, err = parseToken(token, keys)
+			assert.Equal(t, errs.Newf(entity.ErrCodeInvalidToken, "Invalid token: unknown kid %s", active.Kid), err)
+			paths, _ = filepath.Glob(filepath.Join(dir, "*.pem"))
+			assert.Len(t, paths, 1)
+		})
+	}
+}
+
+// Test_KeyRing_Load ...
+func Test_KeyRing_Load(t *testing.T) {
+	dir := t.TempDir()
+	for _, kid := range []string{"20200101000000-old1", "20200101010000-old2"} {
+		privKey, _, err := GenKey(AlgES256)
+		assert.Nil(t, err)
+		path := filepath.Join(dir, kid+keyFileExt)
+		assert.Nil(t, writeKeyFile(path, AlgES256, privKey))
+		// copied or touched files keep the age of their key
+		assert.Nil(t, os.Chtimes(path, time.Now(), time.Now()))
+	}
+
+	// retired years ago, dropped without any rotation
+	keys, err := NewKeyRing(AlgES256, dir)
+	assert.Nil(t, err)
+	assert.Len(t, keys.Keys(), 1)
+	assert.Equal(t, "20200101010000-old2", keys.Active().Kid)
+	assert.Equal(t, time.Date(2020, 1, 1, 1, 0, 0, 0, time.UTC).Unix(), keys.Active().CreateTime)
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.pem"))
+	assert.Len(t, paths, 1)
+
+	privKey, _, err := GenKey(AlgES256)
+	assert.Nil(t, err)
+	assert.Nil(t, writeKeyFile(filepath.Join(dir, "mykey.pem"), AlgES256, privKey))
+	_, err = NewKeyRing(AlgES256, dir)
+	assert.Equal(t, filepath.Join(dir, "mykey.pem")+": kid mykey carries no creation time, want <yyyymmddhhmmss>-<suffix>",
+		err.Error())
+}
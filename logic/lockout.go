@@ -0,0 +1,149 @@
+package logic
+
+import (
+	"strings"
+	"time"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/carterdings/authentication/repo/log"
+)
+
+// lockout defaults
+const (
+	defaultLockoutThreshold   = 5
+	defaultIPLockoutThreshold = 20
+	defaultLockoutDuration    = time.Minute
+)
+
+// prefixes of the lockout subjects
+const (
+	userSubject = "user:"
+	ipSubject   = "ip:"
+)
+
+// Unlock forget the failed logins of a user or a client IP, lifting its lockout
+func (s *service) Unlock(req *entity.LockoutReq) error {
+	if req.UserName == "" && req.ClientIP == "" {
+		return errs.New(entity.ErrCodeInvalidParam, "Empty user name and client ip")
+	}
+	s.lockoutLock.Lock()
+	defer s.lockoutLock.Unlock()
+	for _, subject := range lockoutSubjects(req.UserName, req.ClientIP) {
+		dao.Delete((&entity.LoginFailures{Subject: subject}).Key())
+		log.Infof("Lockout of %s lifted", subject)
+	}
+	return nil
+}
+
+// reserveAttempt fail while the user or the client IP is locked out, or count the attempt as failed
+// before the credentials are checked, so that concurrent guesses cannot slip past the threshold.
+// Past the threshold each failure locks them out twice as long as the previous one.
+func (s *service) reserveAttempt(userName, clientIP string) error {
+	now := time.Now().Unix()
+	s.lockoutLock.Lock()
+	defer s.lockoutLock.Unlock()
+	subjects := lockoutSubjects(userName, clientIP)
+	for _, subject := range subjects {
+		if lf := loginFailures(subject); lf.LockedUntil > now {
+			return errs.Newf(entity.ErrCodeAccountLocked, "Account locked, retry in %ds", lf.LockedUntil-now)
+		}
+	}
+	for _, subject := range subjects {
+		lf := loginFailures(subject)
+		lf.Count++
+		threshold := s.threshold(subject)
+		if lf.Count >= threshold {
+			lock := lockoutBackoff(s.lockoutDuration, lf.Count-threshold)
+			lf.LockedUntil = now + int64(lock/time.Second)
+			log.Errorf("%s locked out for %v after %d failed attempts", subject, lock, lf.Count)
+		}
+		storeFailures(lf, now)
+	}
+	return nil
+}
+
+// releaseAttempt take back an attempt reserved with reserveAttempt once the credentials proved right,
+// along with the lockout it caused
+func (s *service) releaseAttempt(userName, clientIP string) {
+	now := time.Now().Unix()
+	s.lockoutLock.Lock()
+	defer s.lockoutLock.Unlock()
+	for _, subject := range lockoutSubjects(userName, clientIP) {
+		lf := loginFailures(subject)
+		lf.Count--
+		if lf.Count <= 0 {
+			dao.Delete(lf.Key())
+			continue
+		}
+		if lf.Count < s.threshold(subject) {
+			lf.LockedUntil = 0
+		}
+		storeFailures(lf, now)
+	}
+}
+
+// threshold failures locking subject out
+func (s *service) threshold(subject string) int {
+	if strings.HasPrefix(subject, ipSubject) {
+		return s.ipLockoutThreshold
+	}
+	return s.lockoutThreshold
+}
+
+// loginFailures copy of the failures stored for subject, none if there are not any
+func loginFailures(subject string) *entity.LoginFailures {
+	lf := &entity.LoginFailures{
+		Subject: subject,
+	}
+	if v, ok := dao.Get(lf.Key()); ok {
+		if old, ok := v.(*entity.LoginFailures); ok {
+			failed := *old
+			lf = &failed
+		}
+	}
+	return lf
+}
+
+// storeFailures store lf until the window after its lockout ends
+func storeFailures(lf *entity.LoginFailures, now int64) {
+	ttl := int64(entity.LockoutWindow)
+	if lf.LockedUntil > now {
+		ttl += lf.LockedUntil - now
+	}
+	dao.Set(lf.Key(), lf, time.Duration(ttl)*time.Second)
+}
+
+// clearFailures forget the failed logins of the user after a successful one,
+// those of the client IP stay so that a known password cannot reset them
+func (s *service) clearFailures(userName string) {
+	s.lockoutLock.Lock()
+	defer s.lockoutLock.Unlock()
+	dao.Delete((&entity.LoginFailures{Subject: userSubject + userName}).Key())
+}
+
+// lockoutBackoff base doubled n times, capped at entity.LockoutMax
+func lockoutBackoff(base time.Duration, n int) time.Duration {
+	max := time.Duration(entity.LockoutMax) * time.Second
+	d := base
+	for i := 0; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// lockoutSubjects subjects failures are counted for, the user and the client IP if known
+func lockoutSubjects(userName, clientIP string) []string {
+	subjects := make([]string, 0, 2)
+	if userName != "" {
+		subjects = append(subjects, userSubject+userName)
+	}
+	if clientIP != "" {
+		subjects = append(subjects, ipSubject+clientIP)
+	}
+	return subjects
+}
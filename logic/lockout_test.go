@@ -0,0 +1,146 @@
+package logic
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_lockoutBackoff ...
+func Test_lockoutBackoff(t *testing.T) {
+	assert.Equal(t, time.Minute, lockoutBackoff(time.Minute, 0))
+	assert.Equal(t, 2*time.Minute, lockoutBackoff(time.Minute, 1))
+	assert.Equal(t, 8*time.Minute, lockoutBackoff(time.Minute, 3))
+	assert.Equal(t, time.Hour, lockoutBackoff(time.Minute, 10))
+	assert.Equal(t, time.Hour, lockoutBackoff(time.Minute, 1000))
+}
+
+// Test_AuthService_Lockout ...
+func Test_AuthService_Lockout(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s, err := NewServiceWithConfig(&Config{PrivKey: privKey, PubKey: pubKey, LockoutThreshold: 3, IPLockoutThreshold: 5})
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "guessed", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "guessed"})
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "neighbour", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "neighbour"})
+
+	invalid := errs.New(entity.ErrCodeInvalidPassword, "Invalid password")
+	for i := 0; i < 3; i++ {
+		_, err = s.Authenticate(&entity.UserRoleReq{UserName: "guessed", Password: "bad", ClientIP: "10.0.0.1"})
+		assert.Equal(t, invalid, err)
+	}
+	// the right password does not help any more, from anywhere
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "guessed", Password: "pwd", ClientIP: "10.0.0.2"})
+	assert.Equal(t, entity.ErrCodeAccountLocked, errs.ErrCode(err))
+	// other users are not affected
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "neighbour", Password: "pwd", ClientIP: "10.0.0.1"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidParam, "Empty user name and client ip"), s.Unlock(&entity.LockoutReq{}))
+	assert.Nil(t, s.Unlock(&entity.LockoutReq{UserName: "guessed"}))
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "guessed", Password: "pwd", ClientIP: "10.0.0.2"})
+	assert.Nil(t, err)
+	// a success starts over
+	for i := 0; i < 2; i++ {
+		_, err = s.Authenticate(&entity.UserRoleReq{UserName: "guessed", Password: "bad"})
+		assert.Equal(t, invalid, err)
+	}
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "guessed", Password: "pwd"})
+	assert.Nil(t, err)
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "guessed", Password: "bad"})
+	assert.Equal(t, invalid, err)
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "guessed", Password: "pwd"})
+	assert.Nil(t, err)
+
+	// password spraying from one address, unknown users count too
+	for _, name := range []string{"sprayed1", "sprayed2"} {
+		_, err = s.Authenticate(&entity.UserRoleReq{UserName: name, Password: "bad", ClientIP: "10.0.0.3"})
+		assert.Equal(t, errs.New(entity.ErrCodeUserNotExist, "User not exist"), err)
+	}
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "neighbour", Password: "bad", ClientIP: "10.0.0.3"})
+	assert.Equal(t, invalid, err)
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "guessed", Password: "bad", ClientIP: "10.0.0.3"})
+	assert.Equal(t, invalid, err)
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "sprayed3", Password: "bad", ClientIP: "10.0.0.3"})
+	assert.Equal(t, errs.New(entity.ErrCodeUserNotExist, "User not exist"), err)
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "neighbour", Password: "pwd", ClientIP: "10.0.0.3"})
+	assert.Equal(t, entity.ErrCodeAccountLocked, errs.ErrCode(err))
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "neighbour", Password: "pwd", ClientIP: "10.0.0.4"})
+	assert.Nil(t, err)
+	assert.Nil(t, s.Unlock(&entity.LockoutReq{ClientIP: "10.0.0.3"}))
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "neighbour", Password: "pwd", ClientIP: "10.0.0.3"})
+	assert.Nil(t, err)
+
+	// concurrent guesses are counted before the slow hash, none slips past the threshold
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "raced", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "raced"})
+	results := make(chan error, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Authenticate(&entity.UserRoleReq{UserName: "raced", Password: "bad"})
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+	guesses := 0
+	for err := range results {
+		if errs.ErrCode(err) == entity.ErrCodeInvalidPassword {
+			guesses++
+		}
+	}
+	assert.Equal(t, 3, guesses)
+
+	// successful logins take their attempt back
+	for i := 0; i < 6; i++ {
+		_, err = s.Authenticate(&entity.UserRoleReq{UserName: "neighbour", Password: "pwd", ClientIP: "10.0.0.5"})
+		assert.Nil(t, err)
+	}
+
+	// guessing the current password with a token counts too
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "changed", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "changed"})
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "changed", Password: "pwd"})
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		err = s.ChangePassword(&entity.PasswordReq{Token: rsp.Token, Password: "bad", NewPassword: "new", ClientIP: "10.0.0.6"})
+		assert.Equal(t, invalid, err)
+	}
+	err = s.ChangePassword(&entity.PasswordReq{Token: rsp.Token, Password: "pwd", NewPassword: "new", ClientIP: "10.0.0.6"})
+	assert.Equal(t, entity.ErrCodeAccountLocked, errs.ErrCode(err))
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "changed", Password: "pwd"})
+	assert.Equal(t, entity.ErrCodeAccountLocked, errs.ErrCode(err))
+
+	// so does guessing the second factor with a token
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "stolen", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "stolen"})
+	rsp, err = s.Authenticate(&entity.UserRoleReq{UserName: "stolen", Password: "pwd"})
+	assert.Nil(t, err)
+	enroll, err := s.EnrollTOTP(&entity.MFAReq{Token: rsp.Token})
+	assert.Nil(t, err)
+	secret, _ := b32.DecodeString(enroll.Secret)
+	step := time.Now().Unix() / totpPeriod
+	_, err = s.ConfirmTOTP(&entity.MFAReq{Token: rsp.Token, Code: totpCode(secret, step)})
+	assert.Nil(t, err)
+	wrongOTP := errs.New(entity.ErrCodeInvalidOTP, "Invalid code")
+	err = s.DisableTOTP(&entity.MFAReq{Token: rsp.Token, Code: "000000", ClientIP: "10.0.0.7"})
+	assert.Equal(t, wrongOTP, err)
+	for i := 0; i < 2; i++ {
+		_, err = s.RegenerateRecoveryCodes(&entity.MFAReq{Token: rsp.Token, Code: "000000", ClientIP: "10.0.0.7"})
+		assert.Equal(t, wrongOTP, err)
+	}
+	err = s.DisableTOTP(&entity.MFAReq{Token: rsp.Token, Code: totpCode(secret, step+1), ClientIP: "10.0.0.7"})
+	assert.Equal(t, entity.ErrCodeAccountLocked, errs.ErrCode(err))
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "stolen", Password: "pwd"})
+	assert.Equal(t, entity.ErrCodeAccountLocked, errs.ErrCode(err))
+}
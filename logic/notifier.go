@@ -0,0 +1,54 @@
+package logic
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/carterdings/authentication/repo/log"
+)
+
+// Notifier deliver messages to users out of band, such as password reset codes
+type Notifier interface {
+	Notify(userName, subject, message string) error
+}
+
+// LogNotifier write messages to the service log, for local use
+type LogNotifier struct{}
+
+// Notify notify
+func (n *LogNotifier) Notify(userName, subject, message string) error {
+	log.Infof("Notify %s: %s: %s", userName, subject, message)
+	return nil
+}
+
+// FileNotifier append messages to a file, for local use
+type FileNotifier struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// NewFileNotifier new notifier appending to path
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{
+		Path: path,
+	}
+}
+
+// Notify notify
+func (n *FileNotifier) Notify(userName, subject, message string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f, err := os.OpenFile(n.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s\t%s\t%s\t%s\n", time.Now().Format(time.RFC3339), userName, subject, message)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,25 @@
+package logic
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_FileNotifier ...
+func Test_FileNotifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.txt")
+	n := NewFileNotifier(path)
+	assert.Nil(t, n.Notify("cat", "Password reset", "code 1"))
+	assert.Nil(t, n.Notify("dog", "Password reset", "code 2"))
+
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasSuffix(lines[0], "\tcat\tPassword reset\tcode 1"))
+	assert.True(t, strings.HasSuffix(lines[1], "\tdog\tPassword reset\tcode 2"))
+}
@@ -0,0 +1,282 @@
+package logic
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/carterdings/authentication/entity"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// password hashing algorithms
+const (
+	HashArgon2id = "argon2id"
+	HashBcrypt   = "bcrypt"
+	HashScrypt   = "scrypt"
+	HashPBKDF2   = "pbkdf2-sha256"
+)
+
+// PasswordHasher hash passwords into PHC-style strings recording the algorithm and its parameters
+type PasswordHasher interface {
+	// ID algorithm identifier
+	ID() string
+	// Hash hash password with a fresh salt
+	Hash(password string) (string, error)
+	// Verify check password against a hash produced by this algorithm
+	Verify(password, encoded string) (bool, error)
+	// NeedsRehash whether encoded was produced with other parameters
+	NeedsRehash(encoded string) bool
+}
+
+// NewPasswordHasher new hasher with the default parameters of alg
+func NewPasswordHasher(alg string) (PasswordHasher, error) {
+	switch alg {
+	case HashArgon2id:
+		return &argon2Hasher{time: 3, memory: 64 * 1024, threads: 4, keyLen: 32}, nil
+	case HashBcrypt:
+		return &bcryptHasher{cost: bcrypt.DefaultCost}, nil
+	case HashScrypt:
+		return &scryptHasher{ln: 15, r: 8, p: 1, keyLen: 32}, nil
+	case HashPBKDF2:
+		return &pbkdf2Hasher{iter: 600000, keyLen: 32}, nil
+	}
+	return nil, fmt.Errorf("unsupported password hash %s", alg)
+}
+
+// hashID algorithm identifier of a PHC-style string
+func hashID(encoded string) string {
+	if strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$") {
+		return HashBcrypt
+	}
+	parts := strings.SplitN(encoded, "$", 3)
+	if len(parts) < 3 || parts[0] != "" {
+		return ""
+	}
+	return parts[1]
+}
+
+// verifyPassword check password against any supported PHC-style hash
+func verifyPassword(password, encoded string) (bool, error) {
+	h, err := NewPasswordHasher(hashID(encoded))
+	if err != nil {
+		return false, err
+	}
+	return h.Verify(password, encoded)
+}
+
+// verifyLegacyPassword check password against the sha256(password||salt) digest of old user records
+func verifyLegacyPassword(password string, usr *entity.User) bool {
+	pwd := append([]byte(password), usr.Salt...)
+	digest := hashData(pwd)
+	return subtle.ConstantTimeCompare(digest, usr.Password) == 1
+}
+
+func newSalt() []byte {
+	salt := make([]byte, entity.SaltLen)
+	randBytes(salt)
+	return salt
+}
+
+var b64 = base64.RawStdEncoding
+
+// argon2Hasher $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+type argon2Hasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	keyLen  uint32
+}
+
+func (h *argon2Hasher) ID() string { return HashArgon2id }
+
+func (h *argon2Hasher) Hash(password string) (string, error) {
+	salt := newSalt()
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, h.keyLen)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", HashArgon2id, argon2.Version,
+		h.memory, h.time, h.threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h *argon2Hasher) decode(encoded string) (*argon2Hasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != HashArgon2id {
+		return nil, nil, nil, errors.New("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, errors.New("unsupported argon2 version")
+	}
+	p := &argon2Hasher{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return nil, nil, nil, err
+	}
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p.keyLen = uint32(len(key))
+	return p, salt, key, nil
+}
+
+func (h *argon2Hasher) Verify(password, encoded string) (bool, error) {
+	p, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, p.keyLen)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *argon2Hasher) NeedsRehash(encoded string) bool {
+	p, _, _, err := h.decode(encoded)
+	return err != nil || p.time != h.time || p.memory != h.memory || p.threads != h.threads || p.keyLen != h.keyLen
+}
+
+// bcryptHasher modular crypt format $2a$10$...
+type bcryptHasher struct {
+	cost int
+}
+
+func (h *bcryptHasher) ID() string { return HashBcrypt }
+
+func (h *bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h *bcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *bcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.cost
+}
+
+// scryptHasher $scrypt$ln=15,r=8,p=1$salt$hash
+type scryptHasher struct {
+	ln     int
+	r      int
+	p      int
+	keyLen int
+}
+
+func (h *scryptHasher) ID() string { return HashScrypt }
+
+func (h *scryptHasher) Hash(password string) (string, error) {
+	salt := newSalt()
+	key, err := scrypt.Key([]byte(password), salt, 1<<h.ln, h.r, h.p, h.keyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$%s$ln=%d,r=%d,p=%d$%s$%s", HashScrypt, h.ln, h.r, h.p,
+		b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h *scryptHasher) decode(encoded string) (*scryptHasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[1] != HashScrypt {
+		return nil, nil, nil, errors.New("invalid scrypt hash")
+	}
+	p := &scryptHasher{}
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &p.ln, &p.r, &p.p); err != nil {
+		return nil, nil, nil, err
+	}
+	if p.ln <= 0 || p.ln > 30 {
+		return nil, nil, nil, errors.New("invalid scrypt cost")
+	}
+	salt, err := b64.DecodeString(parts[3])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p.keyLen = len(key)
+	return p, salt, key, nil
+}
+
+func (h *scryptHasher) Verify(password, encoded string) (bool, error) {
+	p, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other, err := scrypt.Key([]byte(password), salt, 1<<p.ln, p.r, p.p, p.keyLen)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *scryptHasher) NeedsRehash(encoded string) bool {
+	p, _, _, err := h.decode(encoded)
+	return err != nil || p.ln != h.ln || p.r != h.r || p.p != h.p || p.keyLen != h.keyLen
+}
+
+// pbkdf2Hasher $pbkdf2-sha256$i=600000$salt$hash
+type pbkdf2Hasher struct {
+	iter   int
+	keyLen int
+}
+
+func (h *pbkdf2Hasher) ID() string { return HashPBKDF2 }
+
+func (h *pbkdf2Hasher) Hash(password string) (string, error) {
+	salt := newSalt()
+	key := pbkdf2.Key([]byte(password), salt, h.iter, h.keyLen, sha256.New)
+	return fmt.Sprintf("$%s$i=%d$%s$%s", HashPBKDF2, h.iter,
+		b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h *pbkdf2Hasher) decode(encoded string) (*pbkdf2Hasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[1] != HashPBKDF2 {
+		return nil, nil, nil, errors.New("invalid pbkdf2 hash")
+	}
+	p := &pbkdf2Hasher{}
+	if _, err := fmt.Sscanf(parts[2], "i=%d", &p.iter); err != nil {
+		return nil, nil, nil, err
+	}
+	salt, err := b64.DecodeString(parts[3])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p.keyLen = len(key)
+	return p, salt, key, nil
+}
+
+func (h *pbkdf2Hasher) Verify(password, encoded string) (bool, error) {
+	p, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := pbkdf2.Key([]byte(password), salt, p.iter, p.keyLen, sha256.New)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *pbkdf2Hasher) NeedsRehash(encoded string) bool {
+	p, _, _, err := h.decode(encoded)
+	return err != nil || p.iter != h.iter || p.keyLen != h.keyLen
+}
@@ -0,0 +1,110 @@
+package logic
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_PasswordHasher ...
+func Test_PasswordHasher(t *testing.T) {
+	tests := []struct {
+		name   string
+		alg    string
+		prefix string
+	}{
+		{"test_argon2id", HashArgon2id, "$argon2id$v=19$m=65536,t=3,p=4$"},
+		{"test_bcrypt", HashBcrypt, "$2a$10$"},
+		{"test_scrypt", HashScrypt, "$scrypt$ln=15,r=8,p=1$"},
+		{"test_pbkdf2", HashPBKDF2, "$pbkdf2-sha256$i=600000$"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewPasswordHasher(tt.alg)
+			assert.Nil(t, err)
+			hash, err := h.Hash("pwd")
+			assert.Nil(t, err)
+			t.Logf("hash: %s", hash)
+			assert.True(t, strings.HasPrefix(hash, tt.prefix))
+			assert.Equal(t, tt.alg, hashID(hash))
+
+			ok, err := verifyPassword("pwd", hash)
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			ok, err = verifyPassword("wrong", hash)
+			assert.Nil(t, err)
+			assert.False(t, ok)
+
+			// salted
+			other, _ := h.Hash("pwd")
+			assert.NotEqual(t, hash, other)
+			assert.False(t, h.NeedsRehash(hash))
+		})
+	}
+
+	h := &argon2Hasher{time: 1, memory: 1024, threads: 1, keyLen: 32}
+	hash, _ := h.Hash("pwd")
+	current, _ := NewPasswordHasher(HashArgon2id)
+	assert.True(t, current.NeedsRehash(hash))
+
+	_, err := NewPasswordHasher("md5")
+	assert.NotNil(t, err)
+}
+
+// Test_AuthService_RehashPassword ...
+func Test_AuthService_RehashPassword(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s := NewServie(privKey, pubKey)
+
+	// legacy sha256 record
+	salt := newSalt()
+	legacy := &entity.User{
+		UserName: "legacy",
+		Salt:     salt,
+		Password: hashData(append([]byte("pwd"), salt...)),
+	}
+	dao.Set(legacy.Key(), legacy, cache.NoExpiration)
+	defer s.DeleteUser(&entity.UserReq{UserName: "legacy"})
+	// weaker parameters
+	weak := &bcryptHasher{cost: 4}
+	hash, _ := weak.Hash("pwd")
+	bcryptUser := &entity.User{
+		UserName:     "weak",
+		PasswordHash: hash,
+	}
+	dao.Set(bcryptUser.Key(), bcryptUser, cache.NoExpiration)
+	defer s.DeleteUser(&entity.UserReq{UserName: "weak"})
+
+	tests := []struct {
+		name string
+		user string
+	}{
+		{"test_1", "legacy"},
+		{"test_2", "weak"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Authenticate(&entity.UserRoleReq{UserName: tt.user, Password: "wrong"})
+			assert.NotNil(t, err)
+			_, err = s.Authenticate(&entity.UserRoleReq{UserName: tt.user, Password: "pwd"})
+			assert.Nil(t, err)
+
+			u, _ := dao.Get((&entity.User{UserName: tt.user}).Key())
+			usr := u.(*entity.User)
+			assert.Equal(t, HashArgon2id, hashID(usr.PasswordHash))
+			assert.Nil(t, usr.Salt)
+			assert.Nil(t, usr.Password)
+
+			// upgraded hash still logs in
+			_, err = s.Authenticate(&entity.UserRoleReq{UserName: tt.user, Password: "pwd"})
+			assert.Nil(t, err)
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package logic
+
+import (
+	"strings"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+)
+
+const (
+	permSep      = ":"
+	permWildcard = "*"
+)
+
+// GrantPermission grant a permission such as "invoice:write" or "invoice:*" to the role
+func (s *service) GrantPermission(req *entity.PermissionReq) error {
+	err := checkPermission(req.Permission)
+	if err != nil {
+		return err
+	}
+	role := &entity.Role{
+		RoleName: req.RoleName,
+	}
+	// checked under the role lock so that a concurrent delete cannot leave dangling permissions
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+	err = checkRoles(role)
+	if err != nil {
+		return err
+	}
+	addToSet(role.PermissionsKey(), req.Permission)
+	return nil
+}
+
+// RevokePermission revoke a permission granted to the role, the very pattern granted is removed
+func (s *service) RevokePermission(req *entity.PermissionReq) error {
+	err := checkPermission(req.Permission)
+	if err != nil {
+		return err
+	}
+	role := &entity.Role{
+		RoleName: req.RoleName,
+	}
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+	err = checkRoles(role)
+	if err != nil {
+		return err
+	}
+	removeFromSet(role.PermissionsKey(), req.Permission)
+	return nil
+}
+
+// CheckPermission check the token user is allowed the permission through its effective roles on the resource
+func (s *service) CheckPermission(req *entity.PermissionReq) (*entity.PermissionRsp, error) {
+	rsp := &entity.PermissionRsp{}
+	err := checkPermission(req.Permission)
+	if err != nil {
+		return rsp, err
+	}
+	ureq := &entity.UserRoleReq{
+		UserName: req.UserName,
+		Token:    req.Token,
+	}
+	_, err = s.checkToken(ureq)
+	if err != nil {
+		return rsp, err
+	}
+	for _, roleName := range effectiveRoles(applicableRoles(ureq.UserName, cleanResource(req.Resource))) {
+		v, _ := dao.Get((&entity.Role{RoleName: roleName}).PermissionsKey())
+		perms, _ := v.(map[string]bool)
+		for perm := range perms {
+			if matchPermission(perm, req.Permission) {
+				rsp.CheckResult = true
+				return rsp, nil
+			}
+		}
+	}
+	return rsp, nil
+}
+
+// checkPermission permissions are non-empty segments separated by ":"
+func checkPermission(perm string) error {
+	if perm == "" {
+		return errs.New(entity.ErrCodeInvalidParam, "Empty permission")
+	}
+	for _, seg := range strings.Split(perm, permSep) {
+		if seg == "" {
+			return errs.Newf(entity.ErrCodeInvalidParam, "Invalid permission %s", perm)
+		}
+	}
+	return nil
+}
+
+// matchPermission whether the granted pattern covers perm, a "*" segment matches any segment
+// and a trailing one matches all the remaining segments, so "*" covers everything
+func matchPermission(pattern, perm string) bool {
+	psegs := strings.Split(pattern, permSep)
+	segs := strings.Split(perm, permSep)
+	for i, p := range psegs {
+		if p == permWildcard && i == len(psegs)-1 {
+			return len(segs) > i
+		}
+		if i >= len(segs) || (p != permWildcard && p != segs[i]) {
+			return false
+		}
+	}
+	return len(segs) == len(psegs)
+}
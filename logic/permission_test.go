@@ -0,0 +1,103 @@
+package logic
+
+import (
+	"testing"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_matchPermission ...
+func Test_matchPermission(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		perm    string
+		want    bool
+	}{
+		{"test_exact", "invoice:write", "invoice:write", true},
+		{"test_other", "invoice:write", "invoice:read", false},
+		{"test_prefix", "invoice", "invoice:write", false},
+		{"test_longer", "invoice:write", "invoice", false},
+		{"test_trailing", "invoice:*", "invoice:write", true},
+		{"test_trailing_deep", "invoice:*", "invoice:line:write", true},
+		{"test_trailing_empty", "invoice:*", "invoice", false},
+		{"test_middle", "invoice:*:write", "invoice:line:write", true},
+		{"test_middle_other", "invoice:*:write", "invoice:line:read", false},
+		{"test_all", "*", "report:read", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, matchPermission(tt.pattern, tt.perm))
+		})
+	}
+}
+
+// Test_AuthService_CheckPermission ...
+func Test_AuthService_CheckPermission(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s := NewServie(privKey, pubKey)
+
+	for _, r := range []string{"p_accountant", "p_auditor"} {
+		assert.Nil(t, s.CreateRole(&entity.RoleReq{RoleName: r}))
+		defer s.DeleteRole(&entity.RoleReq{RoleName: r})
+	}
+	assert.Nil(t, s.AddRoleChild(&entity.RoleReq{RoleName: "p_accountant", ChildRole: "p_auditor"}))
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "permission", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "permission"})
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "permission", RoleName: "p_accountant"}))
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "permission", Password: "pwd"})
+	assert.Nil(t, err)
+	token := rsp.Token
+
+	grants := []struct {
+		name string
+		req  *entity.PermissionReq
+		err  error
+	}{
+		{"test_1", &entity.PermissionReq{RoleName: "p_accountant", Permission: "invoice:*"}, nil},
+		{"test_2", &entity.PermissionReq{RoleName: "p_auditor", Permission: "report:read"}, nil},
+		{"test_3", &entity.PermissionReq{RoleName: "p_auditor", Permission: "report::read"}, errs.New(entity.ErrCodeInvalidParam, "Invalid permission report::read")},
+		{"test_4", &entity.PermissionReq{RoleName: "p_auditor"}, errs.New(entity.ErrCodeInvalidParam, "Empty permission")},
+		{"test_5", &entity.PermissionReq{RoleName: "p_unknown", Permission: "report:read"}, errs.New(entity.ErrCodeRoleNotExist, "Role not exist")},
+	}
+	for _, tt := range grants {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.GrantPermission(tt.req)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+
+	checks := []struct {
+		name   string
+		perm   string
+		result bool
+	}{
+		{"test_wildcard", "invoice:write", true},
+		{"test_inherited", "report:read", true},
+		{"test_denied", "report:write", false},
+	}
+	for _, tt := range checks {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp, err := s.CheckPermission(&entity.PermissionReq{Permission: tt.perm, Token: token})
+			assert.Nil(t, err)
+			assert.Equal(t, tt.result, rsp.CheckResult)
+		})
+	}
+	_, err = s.CheckPermission(&entity.PermissionReq{Permission: "invoice:write", Token: "a.b.c"})
+	assert.Equal(t, entity.ErrCodeInvalidToken, errs.ErrCode(err))
+
+	// revoked at once
+	assert.Nil(t, s.RevokePermission(&entity.PermissionReq{RoleName: "p_accountant", Permission: "invoice:*"}))
+	rsp2, err := s.CheckPermission(&entity.PermissionReq{Permission: "invoice:write", Token: token})
+	assert.Nil(t, err)
+	assert.False(t, rsp2.CheckResult)
+
+	// dropped with the role
+	assert.Nil(t, s.DeleteRole(&entity.RoleReq{RoleName: "p_auditor"}))
+	_, ok := dao.Get("role_permissions_p_auditor")
+	assert.False(t, ok)
+}
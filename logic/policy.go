@@ -0,0 +1,169 @@
+package logic
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/carterdings/authentication/repo/log"
+)
+
+// password policy defaults
+const (
+	defaultPasswordMinLength = 1
+	// defaultPasswordMaxLength bounds the work of hashing a password
+	defaultPasswordMaxLength = 128
+	// minUserNameCheck shorter user names are too likely to appear by chance
+	minUserNameCheck = 3
+)
+
+// PasswordPolicy rules new passwords follow, the zero value only rejects empty and over-long ones
+type PasswordPolicy struct {
+	// MinLength and MaxLength characters, 1 and 128 if zero
+	MinLength int
+	MaxLength int
+	// MinClasses of lower case letters, upper case letters, digits and symbols mixed in
+	MinClasses int
+	// RejectUserName reject passwords containing the user name, case-insensitively
+	RejectUserName bool
+	// Breached breached or common passwords rejected, lower case, see LoadPasswordList
+	Breached map[string]bool
+	// History last passwords a new one must differ from, the current one included, not checked if zero
+	History int
+}
+
+// LoadPasswordList load a breached or common password list, one password per line
+func LoadPasswordList(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	list := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		pwd := strings.TrimSpace(scanner.Text())
+		if pwd != "" {
+			list[strings.ToLower(pwd)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read password list %s: %v", path, err)
+	}
+	return list, nil
+}
+
+// Check fail with the rules password breaks, listed in the error details
+func (p *PasswordPolicy) Check(userName, password string) error {
+	minLen, maxLen := p.MinLength, p.MaxLength
+	if minLen <= 0 {
+		minLen = defaultPasswordMinLength
+	}
+	if maxLen <= 0 {
+		maxLen = defaultPasswordMaxLength
+	}
+	var broken []string
+	n := utf8.RuneCountInString(password)
+	if n < minLen {
+		broken = append(broken, fmt.Sprintf("min_length: at least %d characters", minLen))
+	}
+	if n > maxLen {
+		broken = append(broken, fmt.Sprintf("max_length: at most %d characters", maxLen))
+	}
+	if classes := charClasses(password); classes < p.MinClasses {
+		broken = append(broken, fmt.Sprintf(
+			"char_classes: at least %d of lower case letters, upper case letters, digits and symbols", p.MinClasses))
+	}
+	lower := strings.ToLower(password)
+	if p.RejectUserName && utf8.RuneCountInString(userName) >= minUserNameCheck &&
+		strings.Contains(lower, strings.ToLower(userName)) {
+		broken = append(broken, "user_name: must not contain the user name")
+	}
+	if p.Breached[lower] {
+		broken = append(broken, "breached: known from breaches or too common")
+	}
+	if len(broken) > 0 {
+		return errs.NewWithDetails(entity.ErrCodeWeakPassword, "Weak password", broken)
+	}
+	return nil
+}
+
+// checkHistory fail if password is the current one of the user or one of the history
+func (s *service) checkHistory(userName, password string) error {
+	if s.policy.History <= 0 {
+		return nil
+	}
+	u, ok := dao.Get((&entity.User{UserName: userName}).Key())
+	if !ok {
+		return nil
+	}
+	usr, ok := u.(*entity.User)
+	if !ok {
+		return nil
+	}
+	reused := errs.NewWithDetails(entity.ErrCodeWeakPassword, "Weak password",
+		[]string{fmt.Sprintf("history: must differ from the last %d passwords", s.policy.History)})
+	if usr.PasswordHash == "" && usr.Password != nil && verifyLegacyPassword(password, usr) {
+		return reused
+	}
+	hashes := append([]string{usr.PasswordHash}, usr.PasswordHistory...)
+	if len(hashes) > s.policy.History {
+		hashes = hashes[:s.policy.History]
+	}
+	for _, hash := range hashes {
+		if hash == "" {
+			continue
+		}
+		ok, err := verifyPassword(password, hash)
+		if err != nil {
+			log.Errorf("Verify password history of %s: %v", userName, err)
+		}
+		if ok {
+			return reused
+		}
+	}
+	return nil
+}
+
+// passwordHistory history of usr once its password is replaced, the current hash first
+func (s *service) passwordHistory(usr *entity.User) []string {
+	n := s.policy.History - 1
+	if n <= 0 {
+		return nil
+	}
+	history := make([]string, 0, n)
+	if usr.PasswordHash != "" {
+		history = append(history, usr.PasswordHash)
+	}
+	for _, hash := range usr.PasswordHistory {
+		if len(history) == n {
+			break
+		}
+		history = append(history, hash)
+	}
+	return history
+}
+
+// charClasses how many of lower case letters, upper case letters, digits and symbols s mixes
+func charClasses(s string) int {
+	var lower, upper, digit, other int
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
@@ -0,0 +1,138 @@
+package logic
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_PasswordPolicy ...
+func Test_PasswordPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	assert.Nil(t, os.WriteFile(path, []byte("123456\n\n  Password1!  \nqwerty\n"), 0600))
+	breached, err := LoadPasswordList(path)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"123456": true, "password1!": true, "qwerty": true}, breached)
+	_, err = LoadPasswordList(filepath.Join(t.TempDir(), "missing.txt"))
+	assert.NotNil(t, err)
+
+	p := &PasswordPolicy{MinLength: 8, MaxLength: 16, MinClasses: 3, RejectUserName: true, Breached: breached}
+	tests := []struct {
+		name     string
+		userName string
+		password string
+		details  []string
+	}{
+		{"test_ok", "carter", "Correct-horse9", nil},
+		{"test_unicode", "carter", "Ünïcödé-pässwörd", nil},
+		{"test_short", "carter", "Ab1!", []string{"min_length: at least 8 characters"}},
+		{"test_long", "carter", "Correct-horse9-battery", []string{"max_length: at most 16 characters"}},
+		{"test_plain", "carter", "correcthorse", []string{
+			"char_classes: at least 3 of lower case letters, upper case letters, digits and symbols"}},
+		{"test_user_name", "carter", "my-CARTER-99", []string{"user_name: must not contain the user name"}},
+		{"test_short_user_name", "al", "Always-99", nil},
+		{"test_breached", "carter", "PASSWORD1!", []string{"breached: known from breaches or too common"}},
+		{"test_many", "qwerty", "qwerty", []string{
+			"min_length: at least 8 characters",
+			"char_classes: at least 3 of lower case letters, upper case letters, digits and symbols",
+			"user_name: must not contain the user name",
+			"breached: known from breaches or too common",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Check(tt.userName, tt.password)
+			if tt.details == nil {
+				assert.Nil(t, err)
+				return
+			}
+			assert.Equal(t, errs.NewWithDetails(entity.ErrCodeWeakPassword, "Weak password", tt.details), err)
+		})
+	}
+
+	// the zero policy rejects empty and over-long passwords only
+	zero := &PasswordPolicy{}
+	assert.Nil(t, zero.Check("carter", "carter"))
+	assert.Equal(t, []string{"min_length: at least 1 characters"}, errs.ErrDetails(zero.Check("carter", "")))
+	assert.Equal(t, []string{"max_length: at most 128 characters"},
+		errs.ErrDetails(zero.Check("carter", string(make([]byte, 129)))))
+}
+
+// Test_AuthService_PasswordPolicy ...
+func Test_AuthService_PasswordPolicy(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	policy := &PasswordPolicy{MinLength: 10, RejectUserName: true}
+	s, err := NewServiceWithConfig(&Config{PrivKey: privKey, PubKey: pubKey, PasswordPolicy: policy})
+	assert.Nil(t, err)
+
+	err = s.CreateUser(&entity.UserReq{UserName: "policy"})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidParam, "Empty password"), err)
+	err = s.CreateUser(&entity.UserReq{UserName: "policy", Password: "short"})
+	assert.Equal(t, []string{"min_length: at least 10 characters"}, errs.ErrDetails(err))
+	err = s.CreateUser(&entity.UserReq{UserName: "policy", Password: "my-policy-pwd"})
+	assert.Equal(t, []string{"user_name: must not contain the user name"}, errs.ErrDetails(err))
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "policy", Password: "long enough pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "policy"})
+
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "policy", Password: "long enough pwd"})
+	assert.Nil(t, err)
+	// a weak new password changes nothing, sessions stay
+	err = s.ChangePassword(&entity.PasswordReq{Token: rsp.Token, Password: "long enough pwd", NewPassword: "short"})
+	assert.Equal(t, entity.ErrCodeWeakPassword, errs.ErrCode(err))
+	err = s.ResetPassword(&entity.PasswordReq{UserName: "policy", NewPassword: "POLICY0000"})
+	assert.Equal(t, entity.ErrCodeWeakPassword, errs.ErrCode(err))
+	_, err = s.AllRoles(&entity.UserRoleReq{Token: rsp.Token})
+	assert.Nil(t, err)
+	assert.Nil(t, s.ResetPassword(&entity.PasswordReq{UserName: "policy", NewPassword: "another long pwd"}))
+}
+
+// Test_AuthService_PasswordHistory ...
+func Test_AuthService_PasswordHistory(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s, err := NewServiceWithConfig(&Config{PrivKey: privKey, PubKey: pubKey, PasswordPolicy: &PasswordPolicy{History: 3},
+		SnapshotDir: t.TempDir()})
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "history", Password: "pwd1"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "history"})
+	reused := errs.NewWithDetails(entity.ErrCodeWeakPassword, "Weak password",
+		[]string{"history: must differ from the last 3 passwords"})
+	reset := func(pwd string) error {
+		return s.ResetPassword(&entity.PasswordReq{UserName: "history", NewPassword: pwd})
+	}
+
+	assert.Equal(t, reused, reset("pwd1"))
+	assert.Nil(t, reset("pwd2"))
+	assert.Nil(t, reset("pwd3"))
+	assert.Equal(t, reused, reset("pwd1"))
+	assert.Equal(t, reused, reset("pwd2"))
+	u, _ := dao.Get((&entity.User{UserName: "history"}).Key())
+	assert.Len(t, u.(*entity.User).PasswordHistory, 2)
+	// the oldest falls out of the history
+	assert.Nil(t, reset("pwd4"))
+	u, _ = dao.Get((&entity.User{UserName: "history"}).Key())
+	assert.Len(t, u.(*entity.User).PasswordHistory, 2)
+
+	// the history survives a snapshot
+	_, err = s.Snapshot(&entity.SnapshotReq{Name: "history.snap"})
+	assert.Nil(t, err)
+	dao.Delete((&entity.User{UserName: "history"}).Key())
+	_, err = s.Restore(&entity.SnapshotReq{Name: "history.snap"})
+	assert.Nil(t, err)
+	assert.Equal(t, reused, reset("pwd3"))
+	assert.Nil(t, reset("pwd1"))
+
+	// legacy records are checked as well
+	legacy := &entity.User{UserName: "history", Salt: []byte("salt")}
+	legacy.Password = hashData(append([]byte("old"), legacy.Salt...))
+	dao.Set(legacy.Key(), legacy, 0)
+	assert.Equal(t, reused, reset("old"))
+	assert.Nil(t, reset("new"))
+}
@@ -0,0 +1,94 @@
+package logic
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/carterdings/authentication/repo/log"
+)
+
+// recoveryCodeLen characters of a recovery code, shown in two groups
+const recoveryCodeLen = 10
+
+// RecoveryCodes number of the unused recovery codes of the token user
+func (s *service) RecoveryCodes(req *entity.MFAReq) (*entity.MFARsp, error) {
+	rsp := &entity.MFARsp{}
+	ureq := &entity.UserRoleReq{
+		Token: req.Token,
+	}
+	_, err := s.checkToken(ureq)
+	if err != nil {
+		return rsp, err
+	}
+	u, _ := dao.Get((&entity.User{UserName: ureq.UserName}).Key())
+	if usr, ok := u.(*entity.User); ok && usr.TOTPEnabled {
+		rsp.Remaining = len(usr.RecoveryCodes)
+	}
+	return rsp, nil
+}
+
+// RegenerateRecoveryCodes replace the recovery codes of the token user, proven with a second factor code
+func (s *service) RegenerateRecoveryCodes(req *entity.MFAReq) (*entity.MFARsp, error) {
+	rsp := &entity.MFARsp{}
+	ureq := &entity.UserRoleReq{
+		Token: req.Token,
+	}
+	_, err := s.checkToken(ureq)
+	if err != nil {
+		return rsp, err
+	}
+	codes, hashes := newRecoveryCodes()
+	_, err = s.updateWithSecondFactor(ureq.UserName, req.ClientIP, req.Code, func(usr *entity.User) {
+		usr.RecoveryCodes = hashes
+	})
+	if err != nil {
+		return rsp, err
+	}
+	log.Infof("Recovery codes of %s regenerated", ureq.UserName)
+	rsp.RecoveryCodes = codes
+	rsp.Remaining = len(codes)
+	return rsp, nil
+}
+
+// newRecoveryCodes fresh recovery codes and the hashes to be stored
+func newRecoveryCodes() ([]string, [][]byte) {
+	codes := make([]string, 0, entity.RecoveryCodeCount)
+	hashes := make([][]byte, 0, entity.RecoveryCodeCount)
+	buf := make([]byte, recoveryCodeLen*5/8)
+	for i := 0; i < entity.RecoveryCodeCount; i++ {
+		randBytes(buf)
+		code := strings.ToLower(b32.EncodeToString(buf))
+		codes = append(codes, code[:recoveryCodeLen/2]+"-"+code[recoveryCodeLen/2:])
+		hashes = append(hashes, hashData([]byte(code)))
+	}
+	return codes, hashes
+}
+
+// useSecondFactor accept a TOTP code or else a recovery code, which is used up
+func useSecondFactor(usr *entity.User, code string) error {
+	if len(code) == totpDigits {
+		return useTOTP(usr, code)
+	}
+	// tolerate the way codes are written down
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != recoveryCodeLen {
+		return errs.New(entity.ErrCodeInvalidOTP, "Invalid code")
+	}
+	hash := hashData([]byte(code))
+	for i, h := range usr.RecoveryCodes {
+		if subtle.ConstantTimeCompare(hash, h) != 1 {
+			continue
+		}
+		// the slice may be shared with the stored record, never modify it in place
+		rest := make([][]byte, 0, len(usr.RecoveryCodes)-1)
+		rest = append(rest, usr.RecoveryCodes[:i]...)
+		usr.RecoveryCodes = append(rest, usr.RecoveryCodes[i+1:]...)
+		log.Infof("Recovery code of %s used, %d left", usr.UserName, len(usr.RecoveryCodes))
+		return nil
+	}
+	log.Errorf("Invalid recovery code for %s", usr.UserName)
+	return errs.New(entity.ErrCodeInvalidOTP, "Invalid code")
+}
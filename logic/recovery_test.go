@@ -0,0 +1,71 @@
+package logic
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_AuthService_RecoveryCodes ...
+func Test_AuthService_RecoveryCodes(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s := NewServie(privKey, pubKey)
+
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "lostphone", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "lostphone"})
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "lostphone", Password: "pwd"})
+	assert.Nil(t, err)
+	token := rsp.Token
+
+	count, err := s.RecoveryCodes(&entity.MFAReq{Token: token})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count.Remaining)
+	_, err = s.RegenerateRecoveryCodes(&entity.MFAReq{Token: token, Code: "000000"})
+	assert.Equal(t, errs.New(entity.ErrCodeMFAConflict, "MFA not enabled"), err)
+
+	enroll, err := s.EnrollTOTP(&entity.MFAReq{Token: token})
+	assert.Nil(t, err)
+	secret, _ := b32.DecodeString(enroll.Secret)
+	step := time.Now().Unix() / totpPeriod
+	confirm, err := s.ConfirmTOTP(&entity.MFAReq{Token: token, Code: totpCode(secret, step)})
+	assert.Nil(t, err)
+	codes := confirm.RecoveryCodes
+	assert.Len(t, codes, entity.RecoveryCodeCount)
+
+	// the second factor step takes a recovery code, once
+	rsp, err = s.Authenticate(&entity.UserRoleReq{UserName: "lostphone", Password: "pwd"})
+	assert.Nil(t, err)
+	_, err = s.CompleteMFA(&entity.MFAReq{MFAToken: rsp.MFAToken, Code: "aaaaa-aaaaa"})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidOTP, "Invalid code"), err)
+	rsp, err = s.CompleteMFA(&entity.MFAReq{MFAToken: rsp.MFAToken, Code: codes[0]})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, rsp.Token)
+	rsp, err = s.Authenticate(&entity.UserRoleReq{UserName: "lostphone", Password: "pwd"})
+	assert.Nil(t, err)
+	_, err = s.CompleteMFA(&entity.MFAReq{MFAToken: rsp.MFAToken, Code: codes[0]})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidOTP, "Invalid code"), err)
+	// written down in upper case and without the dash
+	_, err = s.CompleteMFA(&entity.MFAReq{MFAToken: rsp.MFAToken, Code: strings.ToUpper(strings.Replace(codes[1], "-", "", 1))})
+	assert.Nil(t, err)
+
+	count, err = s.RecoveryCodes(&entity.MFAReq{Token: token})
+	assert.Nil(t, err)
+	assert.Equal(t, entity.RecoveryCodeCount-2, count.Remaining)
+
+	regen, err := s.RegenerateRecoveryCodes(&entity.MFAReq{Token: token, Code: codes[2]})
+	assert.Nil(t, err)
+	assert.Len(t, regen.RecoveryCodes, entity.RecoveryCodeCount)
+	assert.Equal(t, entity.RecoveryCodeCount, regen.Remaining)
+	// the previous ones are gone
+	err = s.DisableTOTP(&entity.MFAReq{Token: token, Code: codes[3]})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidOTP, "Invalid code"), err)
+	assert.Nil(t, s.DisableTOTP(&entity.MFAReq{Token: token, Code: regen.RecoveryCodes[0]}))
+	count, err = s.RecoveryCodes(&entity.MFAReq{Token: token})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count.Remaining)
+}
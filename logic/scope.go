@@ -0,0 +1,64 @@
+package logic
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/carterdings/authentication/entity"
+)
+
+// cleanResource canonical resource path, "project/42/" and "/project/42/*" are both project/42
+func cleanResource(resource string) string {
+	resource = strings.TrimSuffix(resource, "*")
+	resource = strings.Trim(path.Clean("/"+resource), "/")
+	return resource
+}
+
+// splitScope role and resource of a user roles entry
+func splitScope(entry string) (string, string) {
+	i := strings.Index(entry, entity.ScopeSep)
+	if i < 0 {
+		return entry, ""
+	}
+	return entry[:i], entry[i+len(entity.ScopeSep):]
+}
+
+// joinScope user roles entry of role scoped to resource
+func joinScope(roleName, resource string) string {
+	return (&entity.UserRoleReq{RoleName: roleName, Resource: resource}).ScopedRole()
+}
+
+// resourceScopes scopes whose bindings apply to resource: global, its ancestors and itself
+func resourceScopes(resource string) []string {
+	scopes := []string{""}
+	if resource == "" {
+		return scopes
+	}
+	segs := strings.Split(resource, "/")
+	for i := range segs {
+		scopes = append(scopes, strings.Join(segs[:i+1], "/"))
+	}
+	return scopes
+}
+
+// applicableRoles sorted roles bound to the user in a scope applying to resource
+func applicableRoles(userName, resource string) []string {
+	scopes := make(map[string]bool)
+	for _, scope := range resourceScopes(resource) {
+		scopes[scope] = true
+	}
+	seen := make(map[string]bool)
+	for _, entry := range userRoles(userName) {
+		roleName, scope := splitScope(entry)
+		if scopes[scope] {
+			seen[roleName] = true
+		}
+	}
+	rlist := make([]string, 0, len(seen))
+	for k := range seen {
+		rlist = append(rlist, k)
+	}
+	sort.Strings(rlist)
+	return rlist
+}
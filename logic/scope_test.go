@@ -0,0 +1,105 @@
+package logic
+
+import (
+	"testing"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_cleanResource ...
+func Test_cleanResource(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource string
+		want     string
+	}{
+		{"test_empty", "", ""},
+		{"test_plain", "project/42", "project/42"},
+		{"test_slashes", "/project//42/", "project/42"},
+		{"test_wildcard", "project/42/docs/*", "project/42/docs"},
+		{"test_all", "*", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, cleanResource(tt.resource))
+		})
+	}
+}
+
+// Test_AuthService_ScopedRole ...
+func Test_AuthService_ScopedRole(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s := NewServie(privKey, pubKey)
+
+	for _, r := range []string{"s_owner", "s_viewer"} {
+		assert.Nil(t, s.CreateRole(&entity.RoleReq{RoleName: r}))
+		defer s.DeleteRole(&entity.RoleReq{RoleName: r})
+	}
+	assert.Nil(t, s.AddRoleChild(&entity.RoleReq{RoleName: "s_owner", ChildRole: "s_viewer"}))
+	err = s.CreateRole(&entity.RoleReq{RoleName: "s_owner@project"})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidParam, "Invalid role name s_owner@project"), err)
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "scoped", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "scoped"})
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "scoped", RoleName: "s_owner", Resource: "project/42"}))
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "scoped", RoleName: "s_viewer", Resource: "/project/7/"}))
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "scoped", Password: "pwd"})
+	assert.Nil(t, err)
+	token := rsp.Token
+
+	tests := []struct {
+		name     string
+		role     string
+		resource string
+		result   bool
+	}{
+		{"test_scope", "s_owner", "project/42", true},
+		{"test_descendant", "s_owner", "project/42/docs/readme", true},
+		{"test_inherited", "s_viewer", "project/42/docs", true},
+		{"test_other_scope", "s_owner", "project/7", false},
+		{"test_sibling", "s_owner", "project/420", false},
+		{"test_ancestor", "s_owner", "project", false},
+		{"test_global", "s_owner", "", false},
+		{"test_viewer", "s_viewer", "project/7/issues/1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp, err := s.CheckRole(&entity.UserRoleReq{RoleName: tt.role, Resource: tt.resource, Token: token})
+			assert.Nil(t, err)
+			assert.Equal(t, tt.result, rsp.CheckResult)
+		})
+	}
+
+	rsp, err = s.AllRoles(&entity.UserRoleReq{Token: token})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"s_owner@project/42", "s_viewer@project/7"}, rsp.Roles)
+	rsp, err = s.AllRoles(&entity.UserRoleReq{Token: token, Resource: "project/42/docs", Effective: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"s_owner", "s_viewer"}, rsp.Roles)
+
+	// a global binding applies everywhere, removing it keeps the scoped ones
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "scoped", RoleName: "s_owner"}))
+	rsp, err = s.CheckRole(&entity.UserRoleReq{RoleName: "s_owner", Resource: "project/7", Token: token})
+	assert.Nil(t, err)
+	assert.True(t, rsp.CheckResult)
+	assert.Nil(t, s.RemoveRoleFromUser(&entity.UserRoleReq{UserName: "scoped", RoleName: "s_owner"}))
+	rsp, err = s.CheckRole(&entity.UserRoleReq{RoleName: "s_owner", Resource: "project/42", Token: token})
+	assert.Nil(t, err)
+	assert.True(t, rsp.CheckResult)
+	_, ok := dao.Get("role_users_s_owner")
+	assert.True(t, ok)
+	assert.Nil(t, s.RemoveRoleFromUser(&entity.UserRoleReq{UserName: "scoped", RoleName: "s_owner", Resource: "project/42"}))
+	_, ok = dao.Get("role_users_s_owner")
+	assert.False(t, ok)
+
+	// deleting a role drops its scoped bindings
+	assert.Nil(t, s.DeleteRole(&entity.RoleReq{RoleName: "s_viewer"}))
+	_, ok = dao.Get("bind_6_scoped_s_viewer@project/7")
+	assert.False(t, ok)
+	rsp, err = s.AllRoles(&entity.UserRoleReq{Token: token})
+	assert.Nil(t, err)
+	assert.Empty(t, rsp.Roles)
+}
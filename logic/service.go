@@ -1,13 +1,11 @@
 package logic
 
 import (
-	"bytes"
 	"crypto/rand"
-	"encoding/base64"
 	"fmt"
 	mrand "math/rand"
-	"net/url"
-	"strconv"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,48 +16,239 @@ import (
 	"github.com/patrickmn/go-cache"
 )
 
+func init() {
+	// concrete types stored through dao, needed by durable clients
+	dao.Register(&entity.User{}, &entity.Role{}, map[string]bool{},
+		&entity.Claims{}, &entity.RefreshToken{}, &entity.TokenFamily{}, &entity.Binding{},
+		&entity.ResetCode{}, &entity.MFAChallenge{},
+		&entity.WebAuthnChallenge{}, &entity.WebAuthnCredential{}, &entity.LoginFailures{})
+}
+
 // AuthService service interface
 type AuthService interface {
 	CreateUser(req *entity.UserReq) error
 	DeleteUser(req *entity.UserReq) error
 	CreateRole(req *entity.RoleReq) error
 	DeleteRole(req *entity.RoleReq) error
+	AddRoleChild(req *entity.RoleReq) error
+	RemoveRoleChild(req *entity.RoleReq) error
+	GrantPermission(req *entity.PermissionReq) error
+	RevokePermission(req *entity.PermissionReq) error
 	AddRoleToUser(req *entity.UserRoleReq) error
+	RemoveRoleFromUser(req *entity.UserRoleReq) error
+	ChangePassword(req *entity.PasswordReq) error
+	ResetPassword(req *entity.PasswordReq) error
+	ForgotPassword(req *entity.PasswordReq) error
+	ConfirmReset(req *entity.PasswordReq) error
 	Authenticate(req *entity.UserRoleReq) (*entity.UserRoleRsp, error)
+	Refresh(req *entity.UserRoleReq) (*entity.UserRoleRsp, error)
+	EnrollTOTP(req *entity.MFAReq) (*entity.MFARsp, error)
+	ConfirmTOTP(req *entity.MFAReq) (*entity.MFARsp, error)
+	DisableTOTP(req *entity.MFAReq) error
+	CompleteMFA(req *entity.MFAReq) (*entity.UserRoleRsp, error)
+	RecoveryCodes(req *entity.MFAReq) (*entity.MFARsp, error)
+	RegenerateRecoveryCodes(req *entity.MFAReq) (*entity.MFARsp, error)
+	BeginRegistration(req *entity.WebAuthnReq) (*entity.WebAuthnRsp, error)
+	FinishRegistration(req *entity.WebAuthnReq) (*entity.WebAuthnRsp, error)
+	BeginLogin(req *entity.WebAuthnReq) (*entity.WebAuthnRsp, error)
+	FinishLogin(req *entity.WebAuthnReq) (*entity.UserRoleRsp, error)
 	Invalidate(req *entity.UserRoleReq) error
+	ListSessions(req *entity.SessionReq) (*entity.SessionRsp, error)
+	RevokeSession(req *entity.SessionReq) error
+	RevokeAllSessions(req *entity.SessionReq) error
 	CheckRole(req *entity.UserRoleReq) (*entity.UserRoleRsp, error)
+	CheckAdmin(req *entity.UserRoleReq) error
+	Identify(req *entity.UserRoleReq) error
+	CheckPermission(req *entity.PermissionReq) (*entity.PermissionRsp, error)
 	AllRoles(req *entity.UserRoleReq) (*entity.UserRoleRsp, error)
+	JWKS() *entity.JWKS
+	Snapshot(req *entity.SnapshotReq) (*entity.SnapshotRsp, error)
+	Restore(req *entity.SnapshotReq) (*entity.SnapshotRsp, error)
+	Bootstrap(req *entity.UserReq) error
+	Unlock(req *entity.LockoutReq) error
+	Introspect(req *entity.IntrospectReq) (*entity.IntrospectRsp, error)
+}
+
+// Config service config
+type Config struct {
+	// KeyRing signing keys, a static ring is built from Alg, PrivKey and PubKey if nil
+	KeyRing *KeyRing
+	// Alg token signing algorithm, RS256 if empty
+	Alg string
+	// PrivKey and PubKey PEM encoded keys, both hold the secret for HS256
+	PrivKey []byte
+	PubKey  []byte
+	// PasswordHash password hashing algorithm, argon2id if empty
+	PasswordHash string
+	// Notifier deliver password reset codes, written to the log if nil
+	Notifier Notifier
+	// RPID WebAuthn relying party id, the domain of RPOrigin, localhost if empty
+	RPID string
+	// RPOrigin origin the WebAuthn ceremonies run in, http://localhost:8080 if empty
+	RPOrigin string
+	// LockoutThreshold and IPLockoutThreshold failed logins of a user or from a client IP
+	// before they are locked out, 5 and 20 if zero
+	LockoutThreshold   int
+	IPLockoutThreshold int
+	// LockoutDuration first lockout, doubled on every further failure, a minute if zero
+	LockoutDuration time.Duration
+	// PasswordPolicy rules of new passwords, only empty and over-long ones are rejected if nil
+	PasswordPolicy *PasswordPolicy
+	// TokenFormat access tokens issued, TokenJWT if empty or TokenOpaque
+	TokenFormat string
+	// Clients secrets of the clients allowed to introspect tokens by client id, none if nil
+	Clients map[string]string
+	// SnapshotDir directory snapshots are written to and restored from, snapshots are disabled if empty
+	SnapshotDir string
 }
 
-// NewServie new service
+// NewServie new service signing RS256 tokens
 func NewServie(privKey, pubKey []byte) AuthService {
+	keys, _ := NewStaticKeyRing(AlgRS256, privKey, pubKey)
+	hasher, _ := NewPasswordHasher(HashArgon2id)
 	return &service{
-		privKey: privKey,
-		pubKey:  pubKey,
+		keys:     keys,
+		hasher:   hasher,
+		notifier: &LogNotifier{},
+		rpID:     defaultRPID,
+		rpOrigin: defaultRPOrigin,
+		policy:   &PasswordPolicy{},
+
+		tokenFormat: TokenJWT,
+
+		lockoutThreshold:   defaultLockoutThreshold,
+		ipLockoutThreshold: defaultIPLockoutThreshold,
+		lockoutDuration:    defaultLockoutDuration,
+	}
+}
+
+// NewServiceWithConfig new service from config
+func NewServiceWithConfig(cfg *Config) (AuthService, error) {
+	keys := cfg.KeyRing
+	if keys == nil {
+		alg := cfg.Alg
+		if alg == "" {
+			alg = AlgRS256
+		}
+		var err error
+		keys, err = NewStaticKeyRing(alg, cfg.PrivKey, cfg.PubKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	alg := cfg.PasswordHash
+	if alg == "" {
+		alg = HashArgon2id
+	}
+	hasher, err := NewPasswordHasher(alg)
+	if err != nil {
+		return nil, err
+	}
+	notifier := cfg.Notifier
+	if notifier == nil {
+		notifier = &LogNotifier{}
+	}
+	rpID := cfg.RPID
+	if rpID == "" {
+		rpID = defaultRPID
+	}
+	rpOrigin := cfg.RPOrigin
+	if rpOrigin == "" {
+		rpOrigin = defaultRPOrigin
+	}
+	policy := cfg.PasswordPolicy
+	if policy == nil {
+		policy = &PasswordPolicy{}
+	}
+	format := cfg.TokenFormat
+	switch format {
+	case "":
+		format = TokenJWT
+	case TokenJWT, TokenOpaque:
+	default:
+		return nil, fmt.Errorf("unsupported token format %s", format)
+	}
+	clients := make(map[string][]byte, len(cfg.Clients))
+	for id, secret := range cfg.Clients {
+		clients[id] = hashData([]byte(secret))
+	}
+	s := &service{
+		keys:     keys,
+		hasher:   hasher,
+		notifier: notifier,
+		rpID:     rpID,
+		rpOrigin: rpOrigin,
+		policy:   policy,
+
+		tokenFormat: format,
+		clients:     clients,
+		snapshotDir: cfg.SnapshotDir,
+
+		lockoutThreshold:   cfg.LockoutThreshold,
+		ipLockoutThreshold: cfg.IPLockoutThreshold,
+		lockoutDuration:    cfg.LockoutDuration,
 	}
+	if s.lockoutThreshold <= 0 {
+		s.lockoutThreshold = defaultLockoutThreshold
+	}
+	if s.ipLockoutThreshold <= 0 {
+		s.ipLockoutThreshold = defaultIPLockoutThreshold
+	}
+	if s.lockoutDuration <= 0 {
+		s.lockoutDuration = defaultLockoutDuration
+	}
+	return s, nil
 }
 
 // service service
 type service struct {
-	privKey []byte
-	pubKey  []byte
+	keys     *KeyRing
+	hasher   PasswordHasher
+	notifier Notifier
+	rpID     string
+	rpOrigin string
+	policy   *PasswordPolicy
 
-	userLock sync.Mutex
-	roleLock sync.Mutex
-	bindLock sync.Mutex
+	tokenFormat string
+	// clients sha256 of the client secrets by client id
+	clients     map[string][]byte
+	snapshotDir string
+
+	lockoutThreshold   int
+	ipLockoutThreshold int
+	lockoutDuration    time.Duration
+
+	userLock    sync.Mutex
+	roleLock    sync.Mutex
+	bindLock    sync.Mutex
+	tokenLock   sync.Mutex
+	refreshLock sync.Mutex
+	resetLock   sync.Mutex
+	mfaLock     sync.Mutex
+	// webauthnLock guards the challenges and the sign counters
+	webauthnLock sync.Mutex
+	lockoutLock  sync.Mutex
 }
 
 // CreateUser create user
 func (s *service) CreateUser(req *entity.UserReq) error {
-	salt := make([]byte, entity.SaltLen)
-	randBytes(salt)
-
-	pwd := append([]byte(req.Password), salt...)
+	if entity.ReservedUserName(req.UserName) {
+		return errs.Newf(entity.ErrCodeInvalidParam, "Invalid user name %s", req.UserName)
+	}
+	if req.Password == "" {
+		return errs.New(entity.ErrCodeInvalidParam, "Empty password")
+	}
+	if err := s.policy.Check(req.UserName, req.Password); err != nil {
+		return err
+	}
+	hash, err := s.hasher.Hash(req.Password)
+	if err != nil {
+		return errs.Newf(entity.ErrCodeHashPassword, "hash password: %v", err)
+	}
 	user := &entity.User{
-		UserName:   req.UserName,
-		Salt:       salt,
-		Password:   hashData(pwd),
-		CreateTime: time.Now().Unix(),
+		UserName:     req.UserName,
+		PasswordHash: hash,
+		CreateTime:   time.Now().Unix(),
 	}
 	s.userLock.Lock()
 	_, ok := dao.Get(user.Key())
@@ -90,6 +279,31 @@ func (s *service) DeleteUser(req *entity.UserReq) error {
 		return errs.New(entity.ErrCodeUserNotExist, "User not exist")
 	}
 	dao.Delete(user.Key())
+
+	// drop bindings
+	s.bindLock.Lock()
+	ur, _ := dao.Get(user.UserRolesKey())
+	roles, _ := ur.(map[string]bool)
+	for entry := range roles {
+		roleName, resource := splitScope(entry)
+		role := &entity.Role{RoleName: roleName}
+		bind := &entity.UserRoleReq{UserName: user.UserName, RoleName: roleName, Resource: resource}
+		dao.Delete(bind.Key())
+		removeFromSet(role.UsersKey(), user.UserName)
+	}
+	dao.Delete(user.UserRolesKey())
+	s.bindLock.Unlock()
+
+	// revoke tokens, all sessions end
+	s.revokeUserTokens(user.UserName)
+	dao.Delete((&entity.ResetCode{UserName: user.UserName}).Key())
+	uc, _ := dao.Get(user.CredentialsKey())
+	creds, _ := uc.(map[string]bool)
+	for id := range creds {
+		dao.Delete((&entity.WebAuthnCredential{ID: id}).Key())
+	}
+	dao.Delete(user.CredentialsKey())
+
 	// free lock
 	s.userLock.Unlock()
 	return nil
@@ -97,6 +311,9 @@ func (s *service) DeleteUser(req *entity.UserReq) error {
 
 // CreateRole create role
 func (s *service) CreateRole(req *entity.RoleReq) error {
+	if req.RoleName == "" || strings.Contains(req.RoleName, entity.ScopeSep) || entity.ReservedRoleName(req.RoleName) {
+		return errs.Newf(entity.ErrCodeInvalidParam, "Invalid role name %s", req.RoleName)
+	}
 	role := &entity.Role{
 		RoleName:   req.RoleName,
 		CreateTime: time.Now().Unix(),
@@ -130,6 +347,31 @@ func (s *service) DeleteRole(req *entity.RoleReq) error {
 		return errs.New(entity.ErrCodeRoleNotExist, "Role not exist")
 	}
 	dao.Delete(role.Key())
+
+	// strip the role from every user through the reverse index
+	s.bindLock.Lock()
+	ru, _ := dao.Get(role.UsersKey())
+	users, _ := ru.(map[string]bool)
+	for userName := range users {
+		user := &entity.User{UserName: userName}
+		ur, _ := dao.Get(user.UserRolesKey())
+		for entry := range copySet(ur) {
+			roleName, resource := splitScope(entry)
+			if roleName != role.RoleName {
+				continue
+			}
+			bind := &entity.UserRoleReq{UserName: userName, RoleName: roleName, Resource: resource}
+			dao.Delete(bind.Key())
+			removeFromSet(user.UserRolesKey(), entry)
+		}
+	}
+	dao.Delete(role.UsersKey())
+	s.bindLock.Unlock()
+
+	// detach the role from the hierarchy
+	dropRoleEdges(role)
+	dao.Delete(role.PermissionsKey())
+
 	// free lock
 	s.roleLock.Unlock()
 	return nil
@@ -140,124 +382,224 @@ func (s *service) AddRoleToUser(req *entity.UserRoleReq) error {
 	user := &entity.User{
 		UserName: req.UserName,
 	}
+	role := &entity.Role{
+		RoleName: req.RoleName,
+	}
+	req.Resource = cleanResource(req.Resource)
+	now := time.Now().Unix()
+	if req.ExpireAt != 0 && (req.ExpireAt <= now || req.ExpireAt <= req.NotBefore) {
+		return errs.New(entity.ErrCodeInvalidParam, "Invalid expire_at")
+	}
+	bind := &entity.Binding{
+		UserName:   req.UserName,
+		RoleName:   req.RoleName,
+		Resource:   req.Resource,
+		NotBefore:  req.NotBefore,
+		ExpireAt:   req.ExpireAt,
+		CreateTime: now,
+	}
+	// a time-bound binding is purged by the store once expired
+	ttl := cache.NoExpiration
+	if req.ExpireAt != 0 {
+		ttl = time.Until(time.Unix(req.ExpireAt, 0))
+	}
+	// checked under the bind lock so that a concurrent delete cannot leave a dangling binding
+	s.bindLock.Lock()
+	err := checkUserRole(user, role)
+	if err != nil {
+		s.bindLock.Unlock()
+		return err
+	}
+	pruneRoles(user.UserName)
+	addToSet(user.UserRolesKey(), req.ScopedRole())
+	addToSet(role.UsersKey(), user.UserName)
+	dao.Set(req.Key(), bind, ttl)
+	s.bindLock.Unlock()
+	return nil
+}
+
+// RemoveRoleFromUser remove role from user
+func (s *service) RemoveRoleFromUser(req *entity.UserRoleReq) error {
+	user := &entity.User{
+		UserName: req.UserName,
+	}
+	role := &entity.Role{
+		RoleName: req.RoleName,
+	}
+	req.Resource = cleanResource(req.Resource)
+	// the roles map, the reverse index and the bind key change together
+	s.bindLock.Lock()
+	err := checkUserRole(user, role)
+	if err != nil {
+		s.bindLock.Unlock()
+		return err
+	}
+	removeFromSet(user.UserRolesKey(), req.ScopedRole())
+	dao.Delete(req.Key())
+	if !roleBound(user.UserName, role.RoleName) {
+		removeFromSet(role.UsersKey(), user.UserName)
+	}
+	s.bindLock.Unlock()
+	return nil
+}
+
+func checkUserRole(user *entity.User, role *entity.Role) error {
 	_, ok := dao.Get(user.Key())
 	if !ok {
 		// user not exists
 		log.Errorf("User %s not exist", user.Key())
 		return errs.New(entity.ErrCodeUserNotExist, "User not exist")
 	}
-	role := &entity.Role{
-		RoleName: req.RoleName,
-	}
 	_, ok = dao.Get(role.Key())
 	if !ok {
 		// role not exist
 		log.Errorf("Role %s not exist", role.Key())
 		return errs.New(entity.ErrCodeRoleNotExist, "Role not exist")
 	}
-
-	roles := make(map[string]bool)
-	s.bindLock.Lock()
-	ur, ok := dao.Get(user.UserRolesKey())
-	if ok {
-		// find roles
-		roles = ur.(map[string]bool)
-	}
-	roles[req.RoleName] = true
-	dao.Set(user.UserRolesKey(), roles, cache.NoExpiration)
-	s.bindLock.Unlock()
-
-	dao.Set(req.Key(), nil, cache.NoExpiration)
 	return nil
 }
 
 // Authenticate authenticate
 func (s *service) Authenticate(req *entity.UserRoleReq) (*entity.UserRoleRsp, error) {
 	rsp := &entity.UserRoleRsp{}
+	err := s.reserveAttempt(req.UserName, req.ClientIP)
+	if err != nil {
+		return rsp, err
+	}
+	usr, err := s.verifyUser(req.UserName, req.Password)
+	if err != nil {
+		// unknown users count as well, a lockout tells nothing about existence
+		return rsp, err
+	}
+	s.releaseAttempt(req.UserName, req.ClientIP)
+	if usr.TOTPEnabled {
+		// tokens are issued once the second factor is in
+		return newChallenge(usr, req), nil
+	}
+	s.clearFailures(usr.UserName)
+	return s.issueTokens(usr, newFamily(usr.UserName, req))
+}
+
+// verifyUser check the password of the user, a hash of an outdated algorithm is upgraded on the way
+func (s *service) verifyUser(userName, password string) (*entity.User, error) {
 	user := &entity.User{
-		UserName: req.UserName,
+		UserName: userName,
 	}
 	// query user
 	u, ok := dao.Get(user.Key())
 	if !ok {
-		return rsp, errs.New(entity.ErrCodeUserNotExist, "User not exist")
+		return nil, errs.New(entity.ErrCodeUserNotExist, "User not exist")
 	}
 	usr, ok := u.(*entity.User)
 	if !ok {
-		return rsp, errs.New(entity.ErrCodeUserNotExist, "User not exist")
+		return nil, errs.New(entity.ErrCodeUserNotExist, "User not exist")
 	}
-	pwd := append([]byte(req.Password), usr.Salt...)
 	// check password
-	digest := hashData(pwd)
-	if !bytes.Equal(digest, usr.Password) {
-		return rsp, errs.New(entity.ErrCodeInvalidPassword, "Invalid password")
-	}
-	buf := make([]byte, 16)
-	randBytes(buf)
-	random := base64.RawURLEncoding.EncodeToString(buf)
-	// generate token
-	tok := &entity.Token{
-		UserName:  req.UserName,
-		Password:  digest,
-		Rand:      random,
-		Timestamp: time.Now().Unix(),
-		Expire:    entity.TokenExpire,
-	}
-	token, err := genToken(tok, s.privKey)
+	if usr.PasswordHash == "" {
+		// legacy sha256 record
+		if !verifyLegacyPassword(password, usr) {
+			return nil, errs.New(entity.ErrCodeInvalidPassword, "Invalid password")
+		}
+		return s.rehashPassword(usr, password), nil
+	}
+	ok, err := verifyPassword(password, usr.PasswordHash)
 	if err != nil {
-		return rsp, errs.Newf(entity.ErrCodeGenToken, "generate token: %v", err)
+		log.Errorf("Verify password of %s: %v", usr.UserName, err)
 	}
-	rsp.Token = token
-	dao.Set(token, nil, time.Duration(entity.TokenExpire)*time.Second)
-	return rsp, nil
+	if !ok {
+		return nil, errs.New(entity.ErrCodeInvalidPassword, "Invalid password")
+	}
+	if hashID(usr.PasswordHash) != s.hasher.ID() || s.hasher.NeedsRehash(usr.PasswordHash) {
+		usr = s.rehashPassword(usr, password)
+	}
+	return usr, nil
 }
 
-func (s *service) checkToken(req *entity.UserRoleReq) error {
-	user := &entity.User{
-		UserName: req.UserName,
-	}
-	// query user
-	u, ok := dao.Get(user.Key())
-	if !ok {
-		return errs.New(entity.ErrCodeUserNotExist, "User not exist")
+// rehashPassword store the password hashed with the current algorithm, the record
+// is left as is if it was changed meanwhile or hashing fails
+func (s *service) rehashPassword(usr *entity.User, password string) *entity.User {
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		log.Errorf("Rehash password of %s: %v", usr.UserName, err)
+		return usr
 	}
-	usr, ok := u.(*entity.User)
-	if !ok {
-		return errs.New(entity.ErrCodeUserNotExist, "User not exist")
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+	u, ok := dao.Get(usr.Key())
+	if !ok || u != usr {
+		return usr
+	}
+	upgraded := *usr
+	upgraded.PasswordHash = hash
+	upgraded.Salt = nil
+	upgraded.Password = nil
+	dao.Set(upgraded.Key(), &upgraded, cache.NoExpiration)
+	log.Infof("Password of %s rehashed with %s", usr.UserName, s.hasher.ID())
+	return &upgraded
+}
+
+// checkToken verify the token and that it is not invalidated, the token subject
+// fills an empty req.UserName and must match a given one
+func (s *service) checkToken(req *entity.UserRoleReq) (*entity.Claims, error) {
+	if req.UserName != "" {
+		// query user
+		_, ok := dao.Get((&entity.User{UserName: req.UserName}).Key())
+		if !ok {
+			return nil, errs.New(entity.ErrCodeUserNotExist, "User not exist")
+		}
 	}
 	// check token
-	err := checkToken(req.Token, usr, s.pubKey)
+	claims, err := s.tokenClaims(req.Token)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if req.UserName == "" {
+		req.UserName = claims.Sub
+	}
+	if claims.Sub != req.UserName {
+		return nil, errs.New(entity.ErrCodeInvalidToken, "Invalid token: user mismatch")
+	}
+	u, ok := dao.Get((&entity.User{UserName: req.UserName}).Key())
+	if !ok {
+		return nil, errs.New(entity.ErrCodeUserNotExist, "User not exist")
+	}
+	// issued before a password change
+	if usr, ok := u.(*entity.User); ok && usr.CredVersion != claims.Cv {
+		return nil, errs.New(entity.ErrCodeInvalidToken, "Invalid token: credentials changed")
 	}
 	// check token if invalidated
-	_, ok = dao.Get(req.Token)
+	_, ok = dao.Get(claims.Key())
 	if !ok {
-		return errs.New(entity.ErrCodeInvalidToken, "Invalid token: invalidated")
+		return nil, errs.New(entity.ErrCodeInvalidToken, "Invalid token: invalidated")
 	}
-	return nil
+	return claims, nil
 }
 
 // Invalidate invalidate
 func (s *service) Invalidate(req *entity.UserRoleReq) error {
-	err := s.checkToken(req)
+	claims, err := s.checkToken(req)
 	if err != nil {
 		return err
 	}
 	// invalidate
-	dao.Delete(req.Token)
+	dao.Delete(claims.Key())
+	user := &entity.User{
+		UserName: req.UserName,
+	}
+	s.tokenLock.Lock()
+	removeFromSet(user.TokensKey(), claims.Key())
+	s.tokenLock.Unlock()
 	return nil
 }
 
 // CheckRole check role
 func (s *service) CheckRole(req *entity.UserRoleReq) (*entity.UserRoleRsp, error) {
 	rsp := &entity.UserRoleRsp{}
-	err := s.checkToken(req)
+	_, err := s.checkToken(req)
 	if err != nil {
 		return rsp, err
 	}
-	_, ok := dao.Get(req.Key())
-	if !ok {
+	if !hasRole(req.UserName, req.RoleName, cleanResource(req.Resource)) {
 		// role not match user
 		return rsp, nil
 	}
@@ -265,80 +607,202 @@ func (s *service) CheckRole(req *entity.UserRoleReq) (*entity.UserRoleRsp, error
 	return rsp, nil
 }
 
+// Identify check the caller token is live and fill in its user
+func (s *service) Identify(req *entity.UserRoleReq) error {
+	if req.Token == "" {
+		return errs.New(entity.ErrCodeInvalidToken, "Empty token")
+	}
+	_, err := s.checkToken(req)
+	return err
+}
+
+// CheckAdmin check the caller token is live and its user holds the admin role
+func (s *service) CheckAdmin(req *entity.UserRoleReq) error {
+	if req.Token == "" {
+		return errs.New(entity.ErrCodeInvalidToken, "Empty token")
+	}
+	_, err := s.checkToken(req)
+	if err != nil {
+		return err
+	}
+	// the live bindings are checked rather than the roles claim, so that a revoked admin loses access at once
+	if !hasRole(req.UserName, entity.AdminRole, "") {
+		log.Errorf("Permission denied to %s", req.UserName)
+		return errs.New(entity.ErrCodePermissionDenied, "Permission denied")
+	}
+	return nil
+}
+
+// Bootstrap create the admin role and bind it to a new admin user, unless some user already holds it
+func (s *service) Bootstrap(req *entity.UserReq) error {
+	if req.UserName == "" || req.Password == "" {
+		return errs.New(entity.ErrCodeInvalidParam, "Empty admin user or password")
+	}
+	role := &entity.Role{
+		RoleName: entity.AdminRole,
+	}
+	ru, _ := dao.Get(role.UsersKey())
+	if users, _ := ru.(map[string]bool); len(users) > 0 {
+		// not the first start
+		return nil
+	}
+	err := s.CreateRole(&entity.RoleReq{RoleName: entity.AdminRole})
+	if err != nil && errs.ErrCode(err) != entity.ErrCodeRoleExists {
+		return err
+	}
+	// an existing user is never promoted, its password is not the configured one
+	err = s.CreateUser(req)
+	if errs.ErrCode(err) == entity.ErrCodeUserExists {
+		log.Errorf("Bootstrap admin %s skipped: user exists", req.UserName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = s.AddRoleToUser(&entity.UserRoleReq{
+		UserName: req.UserName,
+		RoleName: entity.AdminRole,
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Bootstrap admin %s created", req.UserName)
+	return nil
+}
+
 // AllRoles all roles
 func (s *service) AllRoles(req *entity.UserRoleReq) (*entity.UserRoleRsp, error) {
 	rsp := &entity.UserRoleRsp{}
-	err := s.checkToken(req)
+	_, err := s.checkToken(req)
 	if err != nil {
 		return rsp, err
 	}
-	user := &entity.User{
-		UserName: req.UserName,
+	rlist := userRoles(req.UserName)
+	if req.Resource != "" {
+		// the roles in effect on the resource
+		rlist = applicableRoles(req.UserName, cleanResource(req.Resource))
 	}
-	ur, ok := dao.Get(user.UserRolesKey())
-	if !ok {
-		// no roles
-		return rsp, nil
-	}
-	roles, ok := ur.(map[string]bool)
-	if !ok {
-		return rsp, nil
-	}
-	rlist := make([]string, 0)
-	for k, _ := range roles {
-		rlist = append(rlist, k)
+	if req.Effective {
+		rlist = effectiveRoles(rlist)
 	}
 	rsp.Roles = rlist
 	return rsp, nil
 }
 
-func genToken(tok *entity.Token, privKey []byte) (string, error) {
-	data := append([]byte(fmt.Sprintf("u=%s&r=%s&t=%d&e=%d", tok.UserName, tok.Rand, tok.Timestamp, tok.Expire)),
-		tok.Password...)
-	sign, err := RsaSign(data, privKey)
+// JWKS public keys verifying tokens
+func (s *service) JWKS() *entity.JWKS {
+	return s.keys.JWKS()
+}
+
+// Snapshot dump the whole store to a file of the snapshot directory
+func (s *service) Snapshot(req *entity.SnapshotReq) (*entity.SnapshotRsp, error) {
+	rsp := &entity.SnapshotRsp{}
+	path, err := s.snapshotPath(req.Name)
 	if err != nil {
-		return "", err
+		return rsp, err
 	}
-	token := base64.RawURLEncoding.EncodeToString(sign)
-	v := url.Values{}
-	v.Set("user", tok.UserName)
-	v.Set("rand", tok.Rand)
-	v.Set("ts", strconv.FormatInt(tok.Timestamp, 10))
-	v.Set("expire", strconv.FormatInt(tok.Expire, 10))
-	v.Set("token", token)
-	return v.Encode(), nil
+	unlock := s.lockAll()
+	n, err := dao.DumpFile(path)
+	unlock()
+	if err != nil {
+		log.Errorf("Snapshot %s: %v", path, err)
+		return rsp, errs.Newf(entity.ErrCodeSnapshot, "snapshot: %v", err)
+	}
+	rsp.Entries = n
+	return rsp, nil
 }
 
-func checkToken(token string, user *entity.User, pubKey []byte) error {
-	v, err := url.ParseQuery(token)
+// Restore replace the store with a file of the snapshot directory, no change runs meanwhile
+func (s *service) Restore(req *entity.SnapshotReq) (*entity.SnapshotRsp, error) {
+	rsp := &entity.SnapshotRsp{}
+	path, err := s.snapshotPath(req.Name)
 	if err != nil {
-		return errs.Newf(entity.ErrCodeInvalidToken, "Invalid token: %v", err)
+		return rsp, err
 	}
-	ts, _ := strconv.ParseInt(v.Get("ts"), 10, 64)
-	expire, _ := strconv.ParseInt(v.Get("expire"), 10, 64)
-	now := time.Now().Unix()
-	if now-ts > expire {
-		return errs.New(entity.ErrCodeExpiredToken, "Expired token")
-	}
-	tok := &entity.Token{
-		UserName:  v.Get("user"),
-		Password:  user.Password,
-		Rand:      v.Get("rand"),
-		Timestamp: ts,
-		Expire:    expire,
-	}
-	data := append([]byte(fmt.Sprintf("u=%s&r=%s&t=%d&e=%d", tok.UserName, tok.Rand, tok.Timestamp, tok.Expire)),
-		tok.Password...)
-	tokenStr := v.Get("token")
-	sign, err := base64.RawURLEncoding.DecodeString(tokenStr)
+	unlock := s.lockAll()
+	n, err := dao.RestoreFile(path)
+	unlock()
 	if err != nil {
-		return errs.Newf(entity.ErrCodeInvalidToken, "Invalid token: %v", err)
+		log.Errorf("Restore %s: %v", path, err)
+		return rsp, errs.Newf(entity.ErrCodeRestore, "restore: %v", err)
 	}
-	err = RsaVerify(data, sign, pubKey)
-	if err != nil {
-		return errs.Newf(entity.ErrCodeInvalidToken, "Invalid token: %v", err)
+	rsp.Entries = n
+	return rsp, nil
+}
+
+// snapshotPath path of the snapshot named name, a bare file name in the snapshot directory
+func (s *service) snapshotPath(name string) (string, error) {
+	if s.snapshotDir == "" {
+		return "", errs.New(entity.ErrCodeInvalidParam, "Snapshots disabled, no snapshot directory")
+	}
+	if name == "" {
+		return "", errs.New(entity.ErrCodeInvalidParam, "Empty name")
+	}
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return "", errs.New(entity.ErrCodeInvalidParam, "Invalid name, a file name in the snapshot directory")
+	}
+	return filepath.Join(s.snapshotDir, name), nil
+}
+
+// lockAll take every service lock in the order they nest, for work spanning the whole store
+func (s *service) lockAll() (unlock func()) {
+	locks := []*sync.Mutex{&s.refreshLock, &s.mfaLock, &s.webauthnLock, &s.resetLock,
+		&s.roleLock, &s.userLock, &s.bindLock, &s.tokenLock, &s.lockoutLock}
+	for _, l := range locks {
+		l.Lock()
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+}
+
+// copySet copy of a stored set, stored sets are shared by readers and never modified in place
+func copySet(v interface{}) map[string]bool {
+	set := make(map[string]bool)
+	old, _ := v.(map[string]bool)
+	for k, v := range old {
+		set[k] = v
+	}
+	return set
+}
+
+// addToSet add member to the set stored at key
+func addToSet(key, member string) {
+	v, _ := dao.Get(key)
+	set := copySet(v)
+	set[member] = true
+	dao.Set(key, set, cache.NoExpiration)
+}
+
+// removeFromSet remove member from the set stored at key, the key is dropped once empty
+func removeFromSet(key, member string) {
+	v, ok := dao.Get(key)
+	if !ok {
+		return
+	}
+	set := copySet(v)
+	delete(set, member)
+	if len(set) == 0 {
+		dao.Delete(key)
+		return
+	}
+	dao.Set(key, set, cache.NoExpiration)
+}
+
+// pruneTokens drop the tokens already expired from the token set stored at key
+func pruneTokens(key string) {
+	v, ok := dao.Get(key)
+	if !ok {
+		return
+	}
+	tokens, _ := v.(map[string]bool)
+	for token := range tokens {
+		if _, ok := dao.Get(token); !ok {
+			removeFromSet(key, token)
+		}
 	}
-	return nil
 }
 
 func randBytes(buf []byte) {
@@ -2,6 +2,7 @@ package logic
 
 import (
 	"fmt"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -37,6 +38,10 @@ func Test_AuthService_CreateUser(t *testing.T) {
 			UserName: "cat",
 			Password: "pwd",
 		}, nil},
+		{"test_reserved", &entity.UserReq{
+			UserName: "roles_cat",
+			Password: "pwd",
+		}, errs.New(entity.ErrCodeInvalidParam, "Invalid user name roles_cat")},
 	}
 
 	for _, tt := range tests {
@@ -100,6 +105,9 @@ func Test_AuthService_CreateRole(t *testing.T) {
 		{"test_1", &entity.RoleReq{
 			RoleName: "root",
 		}, nil},
+		{"test_reserved", &entity.RoleReq{
+			RoleName: "users_root",
+		}, errs.New(entity.ErrCodeInvalidParam, "Invalid role name users_root")},
 	}
 
 	for _, tt := range tests {
@@ -110,6 +118,41 @@ func Test_AuthService_CreateRole(t *testing.T) {
 	}
 }
 
+// Test_AuthService_BindingKeys ...
+func Test_AuthService_BindingKeys(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s := NewServie(privKey, pubKey)
+
+	// user bc with role x_viewer and user bc_x with role viewer once shared bind_bc_x_viewer
+	assert.NotEqual(t, (&entity.UserRoleReq{UserName: "bc", RoleName: "x_viewer"}).Key(),
+		(&entity.UserRoleReq{UserName: "bc_x", RoleName: "viewer"}).Key())
+	for _, u := range []string{"bc", "bc_x"} {
+		assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: u, Password: "pwd"}))
+		defer s.DeleteUser(&entity.UserReq{UserName: u})
+	}
+	for _, r := range []string{"x_viewer", "viewer"} {
+		assert.Nil(t, s.CreateRole(&entity.RoleReq{RoleName: r}))
+		defer s.DeleteRole(&entity.RoleReq{RoleName: r})
+	}
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "bc", RoleName: "x_viewer"}))
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "bc_x", RoleName: "viewer"}))
+	roles := func(userName string) []string {
+		rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: userName, Password: "pwd"})
+		assert.Nil(t, err)
+		all, err := s.AllRoles(&entity.UserRoleReq{Token: rsp.Token})
+		assert.Nil(t, err)
+		return all.Roles
+	}
+
+	// removing one binding leaves the other
+	assert.Nil(t, s.RemoveRoleFromUser(&entity.UserRoleReq{UserName: "bc_x", RoleName: "viewer"}))
+	assert.Equal(t, []string{"x_viewer"}, roles("bc"))
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "bc_x", RoleName: "viewer"}))
+	assert.Nil(t, s.DeleteUser(&entity.UserReq{UserName: "bc"}))
+	assert.Equal(t, []string{"viewer"}, roles("bc_x"))
+}
+
 // Test_AuthService_DeleteRole ...
 func Test_AuthService_DeleteRole(t *testing.T) {
 	patches := patchDaoGet(nil)
@@ -172,6 +215,278 @@ func Test_AuthService_AddRoleToUser(t *testing.T) {
 	}
 }
 
+// Test_AuthService_RemoveRoleFromUser ...
+func Test_AuthService_RemoveRoleFromUser(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s := NewServie(privKey, pubKey)
+
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "unbind", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "unbind"})
+	assert.Nil(t, s.CreateRole(&entity.RoleReq{RoleName: "unbind_role"}))
+	defer s.DeleteRole(&entity.RoleReq{RoleName: "unbind_role"})
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "unbind", RoleName: "unbind_role"}))
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "unbind", Password: "pwd"})
+	assert.Nil(t, err)
+	token := rsp.Token
+
+	tests := []struct {
+		name string
+		req  *entity.UserRoleReq
+		err  error
+	}{
+		{"test_1", &entity.UserRoleReq{
+			UserName: "unbind",
+			RoleName: "unbind_role",
+		}, nil},
+		// idempotent
+		{"test_2", &entity.UserRoleReq{
+			UserName: "unbind",
+			RoleName: "unbind_role",
+		}, nil},
+		{"test_3", &entity.UserRoleReq{
+			UserName: "nobody",
+			RoleName: "unbind_role",
+		}, errs.New(entity.ErrCodeUserNotExist, "User not exist")},
+		{"test_4", &entity.UserRoleReq{
+			UserName: "unbind",
+			RoleName: "nothing",
+		}, errs.New(entity.ErrCodeRoleNotExist, "Role not exist")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.RemoveRoleFromUser(tt.req)
+			assert.Equal(t, tt.err, err)
+
+			// existing token sees the change immediately
+			req := &entity.UserRoleReq{UserName: "unbind", RoleName: "unbind_role", Token: token}
+			rsp, err := s.CheckRole(req)
+			assert.Nil(t, err)
+			assert.False(t, rsp.CheckResult)
+			rsp, err = s.AllRoles(req)
+			assert.Nil(t, err)
+			assert.Empty(t, rsp.Roles)
+		})
+	}
+}
+
+// Test_AuthService_DeleteCascade ...
+func Test_AuthService_DeleteCascade(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s := NewServie(privKey, pubKey)
+
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "cascade", Password: "pwd"}))
+	assert.Nil(t, s.CreateRole(&entity.RoleReq{RoleName: "cascade_a"}))
+	assert.Nil(t, s.CreateRole(&entity.RoleReq{RoleName: "cascade_b"}))
+	defer s.DeleteRole(&entity.RoleReq{RoleName: "cascade_b"})
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "cascade", RoleName: "cascade_a"}))
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "cascade", RoleName: "cascade_b"}))
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "cascade", Password: "pwd"})
+	assert.Nil(t, err)
+	token := rsp.Token
+
+	// deleting a role strips it from every user
+	assert.Nil(t, s.DeleteRole(&entity.RoleReq{RoleName: "cascade_a"}))
+	rsp, err = s.CheckRole(&entity.UserRoleReq{UserName: "cascade", RoleName: "cascade_a", Token: token})
+	assert.Nil(t, err)
+	assert.False(t, rsp.CheckResult)
+	rsp, err = s.AllRoles(&entity.UserRoleReq{UserName: "cascade", Token: token})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"cascade_b"}, rsp.Roles)
+	// a re-created role starts without users
+	assert.Nil(t, s.CreateRole(&entity.RoleReq{RoleName: "cascade_a"}))
+	defer s.DeleteRole(&entity.RoleReq{RoleName: "cascade_a"})
+	rsp, err = s.CheckRole(&entity.UserRoleReq{UserName: "cascade", RoleName: "cascade_a", Token: token})
+	assert.Nil(t, err)
+	assert.False(t, rsp.CheckResult)
+
+	// deleting a user drops its bindings and revokes its tokens
+	claims, err := parseToken(token, s.(*service).keys)
+	assert.Nil(t, err)
+	assert.Nil(t, s.DeleteUser(&entity.UserReq{UserName: "cascade"}))
+	_, ok := dao.Get(claims.Key())
+	assert.False(t, ok)
+	_, ok = dao.Get("user_tokens_cascade")
+	assert.False(t, ok)
+	_, ok = dao.Get("bind_7_cascade_cascade_b")
+	assert.False(t, ok)
+	ru, _ := dao.Get("role_users_cascade_b")
+	assert.Nil(t, ru)
+
+	// a re-created user with the same name inherits nothing
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "cascade", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "cascade"})
+	rsp, err = s.Authenticate(&entity.UserRoleReq{UserName: "cascade", Password: "pwd"})
+	assert.Nil(t, err)
+	token = rsp.Token
+	rsp, err = s.CheckRole(&entity.UserRoleReq{UserName: "cascade", RoleName: "cascade_b", Token: token})
+	assert.Nil(t, err)
+	assert.False(t, rsp.CheckResult)
+	rsp, err = s.AllRoles(&entity.UserRoleReq{UserName: "cascade", Token: token})
+	assert.Nil(t, err)
+	assert.Empty(t, rsp.Roles)
+}
+
+// Test_AuthService_TimeBoundRole ...
+func Test_AuthService_TimeBoundRole(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s := NewServie(privKey, pubKey)
+
+	for _, r := range []string{"t_oncall", "t_other"} {
+		assert.Nil(t, s.CreateRole(&entity.RoleReq{RoleName: r}))
+		defer s.DeleteRole(&entity.RoleReq{RoleName: r})
+	}
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "oncall", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "oncall"})
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "oncall", Password: "pwd"})
+	assert.Nil(t, err)
+	token := rsp.Token
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name string
+		req  *entity.UserRoleReq
+		err  error
+	}{
+		{"test_expired", &entity.UserRoleReq{UserName: "oncall", RoleName: "t_oncall", ExpireAt: now - 1},
+			errs.New(entity.ErrCodeInvalidParam, "Invalid expire_at")},
+		{"test_reversed", &entity.UserRoleReq{UserName: "oncall", RoleName: "t_oncall", NotBefore: now + 7200, ExpireAt: now + 3600},
+			errs.New(entity.ErrCodeInvalidParam, "Invalid expire_at")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.AddRoleToUser(tt.req)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+
+	// not active yet
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "oncall", RoleName: "t_oncall", NotBefore: now + 3600}))
+	rsp, err = s.CheckRole(&entity.UserRoleReq{RoleName: "t_oncall", Token: token})
+	assert.Nil(t, err)
+	assert.False(t, rsp.CheckResult)
+	rsp, err = s.AllRoles(&entity.UserRoleReq{Token: token})
+	assert.Nil(t, err)
+	assert.Empty(t, rsp.Roles)
+
+	// active until expiry, then purged
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "oncall", RoleName: "t_oncall", ExpireAt: now + 2}))
+	rsp, err = s.CheckRole(&entity.UserRoleReq{RoleName: "t_oncall", Token: token})
+	assert.Nil(t, err)
+	assert.True(t, rsp.CheckResult)
+	rsp, err = s.AllRoles(&entity.UserRoleReq{Token: token})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"t_oncall"}, rsp.Roles)
+	time.Sleep(time.Until(time.Unix(now+2, 0)) + 100*time.Millisecond)
+	rsp, err = s.CheckRole(&entity.UserRoleReq{RoleName: "t_oncall", Token: token})
+	assert.Nil(t, err)
+	assert.False(t, rsp.CheckResult)
+	rsp, err = s.AllRoles(&entity.UserRoleReq{Token: token})
+	assert.Nil(t, err)
+	assert.Empty(t, rsp.Roles)
+	_, ok := dao.Get("bind_6_oncall_t_oncall")
+	assert.False(t, ok)
+
+	// stale index entries are dropped on the next change
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "oncall", RoleName: "t_other"}))
+	ur, _ := dao.Get("user_roles_oncall")
+	assert.Equal(t, map[string]bool{"t_other": true}, ur)
+	_, ok = dao.Get("role_users_t_oncall")
+	assert.False(t, ok)
+
+	// granting another user never rewrites the window, user oncall_t with role other once shared the key
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "oncall_t", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "oncall_t"})
+	assert.Nil(t, s.CreateRole(&entity.RoleReq{RoleName: "other"}))
+	defer s.DeleteRole(&entity.RoleReq{RoleName: "other"})
+	window := func(userName, roleName string) int64 {
+		v, ok := dao.Get((&entity.UserRoleReq{UserName: userName, RoleName: roleName}).Key())
+		assert.True(t, ok)
+		return v.(*entity.Binding).ExpireAt
+	}
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "oncall", RoleName: "t_other", ExpireAt: now + 3600}))
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "oncall_t", RoleName: "other"}))
+	assert.Equal(t, now+3600, window("oncall", "t_other"))
+	assert.Equal(t, int64(0), window("oncall_t", "other"))
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "oncall_t", RoleName: "other", ExpireAt: now + 60}))
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "oncall", RoleName: "t_other"}))
+	assert.Equal(t, now+60, window("oncall_t", "other"))
+	assert.Equal(t, int64(0), window("oncall", "t_other"))
+}
+
+// Test_AuthService_CheckAdmin ...
+func Test_AuthService_CheckAdmin(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s := NewServie(privKey, pubKey)
+
+	assert.Equal(t, entity.ErrCodeInvalidParam, errs.ErrCode(s.Bootstrap(&entity.UserReq{UserName: "boss"})))
+	assert.Nil(t, s.Bootstrap(&entity.UserReq{UserName: "boss", Password: "pwd"}))
+	defer s.DeleteRole(&entity.RoleReq{RoleName: entity.AdminRole})
+	defer s.DeleteUser(&entity.UserReq{UserName: "boss"})
+	// not the first start any more
+	assert.Nil(t, s.Bootstrap(&entity.UserReq{UserName: "boss2", Password: "pwd"}))
+	_, ok := dao.Get("user_boss2")
+	assert.False(t, ok)
+
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "clerk", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "clerk"})
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "boss", Password: "pwd"})
+	assert.Nil(t, err)
+	adminToken := rsp.Token
+	rsp, err = s.Authenticate(&entity.UserRoleReq{UserName: "clerk", Password: "pwd"})
+	assert.Nil(t, err)
+	clerkToken := rsp.Token
+
+	tests := []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{"test_admin", adminToken, errs.ErrCodeSuccess},
+		{"test_not_admin", clerkToken, entity.ErrCodePermissionDenied},
+		{"test_empty", "", entity.ErrCodeInvalidToken},
+		{"test_invalid", "a.b.c", entity.ErrCodeInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.CheckAdmin(&entity.UserRoleReq{Token: tt.token})
+			assert.Equal(t, tt.code, errs.ErrCode(err))
+		})
+	}
+
+	// the live binding counts, not the roles in the token
+	assert.Nil(t, s.RemoveRoleFromUser(&entity.UserRoleReq{UserName: "boss", RoleName: entity.AdminRole}))
+	err = s.CheckAdmin(&entity.UserRoleReq{Token: adminToken})
+	assert.Equal(t, entity.ErrCodePermissionDenied, errs.ErrCode(err))
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "clerk", RoleName: entity.AdminRole}))
+	assert.Nil(t, s.CheckAdmin(&entity.UserRoleReq{Token: clerkToken}))
+
+	// user a with role b_admin does not make user a_b an admin
+	for _, u := range []string{"a", "a_b"} {
+		assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: u, Password: "pwd"}))
+		defer s.DeleteUser(&entity.UserReq{UserName: u})
+	}
+	assert.Nil(t, s.CreateRole(&entity.RoleReq{RoleName: "b_admin"}))
+	defer s.DeleteRole(&entity.RoleReq{RoleName: "b_admin"})
+	assert.Nil(t, s.AddRoleToUser(&entity.UserRoleReq{UserName: "a", RoleName: "b_admin"}))
+	rsp, err = s.Authenticate(&entity.UserRoleReq{UserName: "a_b", Password: "pwd"})
+	assert.Nil(t, err)
+	err = s.CheckAdmin(&entity.UserRoleReq{Token: rsp.Token})
+	assert.Equal(t, entity.ErrCodePermissionDenied, errs.ErrCode(err))
+	check, err := s.CheckRole(&entity.UserRoleReq{RoleName: entity.AdminRole, Token: rsp.Token})
+	assert.Nil(t, err)
+	assert.False(t, check.CheckResult)
+	rsp, err = s.Authenticate(&entity.UserRoleReq{UserName: "a", Password: "pwd"})
+	assert.Nil(t, err)
+	check, err = s.CheckRole(&entity.UserRoleReq{RoleName: "b_admin", Token: rsp.Token})
+	assert.Nil(t, err)
+	assert.True(t, check.CheckResult)
+}
+
 // Test_AuthService_Authenticate ...
 func Test_AuthService_Authenticate(t *testing.T) {
 	patches := patchDaoGet(nil)
@@ -307,43 +622,96 @@ func Test_AuthService_AllRoles(t *testing.T) {
 	}
 }
 
-// Test_Token ...
-func Test_Token(t *testing.T) {
+// Test_AuthService_Snapshot ...
+func Test_AuthService_Snapshot(t *testing.T) {
 	privKey, pubKey, err := GenRsaKey()
 	assert.Nil(t, err)
+	dir := t.TempDir()
+	s, err := NewServiceWithConfig(&Config{PrivKey: privKey, PubKey: pubKey, SnapshotDir: dir})
+	assert.Nil(t, err)
+
+	err = s.CreateUser(&entity.UserReq{UserName: "snap", Password: "pwd"})
+	assert.Nil(t, err)
+	defer s.DeleteUser(&entity.UserReq{UserName: "snap"})
+	invalid := errs.New(entity.ErrCodeInvalidParam, "Invalid name, a file name in the snapshot directory")
 
 	tests := []struct {
 		name string
-		tk   *entity.Token
+		req  *entity.SnapshotReq
 		err  error
 	}{
-		{"test_1", &entity.Token{
-			UserName:  "cat",
-			Password:  []byte("pwd"),
-			Rand:      "rand",
-			Timestamp: 123456,
-			Expire:    7200,
+		{"test_1", &entity.SnapshotReq{}, errs.New(entity.ErrCodeInvalidParam, "Empty name")},
+		{"test_2", &entity.SnapshotReq{Name: "auth.snap"}, nil},
+		{"test_absolute", &entity.SnapshotReq{Name: filepath.Join(dir, "auth.snap")}, invalid},
+		{"test_parent", &entity.SnapshotReq{Name: "../auth.snap"}, invalid},
+		{"test_dot", &entity.SnapshotReq{Name: ".."}, invalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp, err := s.Snapshot(tt.req)
+			assert.Equal(t, tt.err, err)
+			if err != nil {
+				return
+			}
+			assert.True(t, rsp.Entries > 0)
+
+			dao.Delete("user_snap")
+			dao.Set("user_late", &entity.User{UserName: "late"}, 0)
+			rsp, err = s.Restore(tt.req)
+			assert.Nil(t, err)
+			assert.True(t, rsp.Entries > 0)
+			_, ok := dao.Get("user_snap")
+			assert.True(t, ok)
+			// what came after the snapshot is gone
+			_, ok = dao.Get("user_late")
+			assert.False(t, ok)
+		})
+	}
+
+	// no directory, no snapshots
+	_, err = NewServie(privKey, pubKey).Snapshot(&entity.SnapshotReq{Name: "auth.snap"})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidParam, "Snapshots disabled, no snapshot directory"), err)
+}
+
+// Test_Token ...
+func Test_Token(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	keys, err := NewStaticKeyRing(AlgRS256, privKey, pubKey)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name   string
+		claims *entity.Claims
+		err    error
+	}{
+		{"test_1", &entity.Claims{
+			Sub: "cat",
+			Iat: 123456,
+			Exp: 123456 + 7200,
+			Jti: "rand",
 		}, errs.New(entity.ErrCodeExpiredToken, "Expired token")},
-		{"test_2", &entity.Token{
-			UserName:  "cat",
-			Password:  []byte("pwd"),
-			Rand:      "rand",
-			Timestamp: time.Now().Unix(),
-			Expire:    7200,
+		{"test_2", &entity.Claims{
+			Sub:   "cat",
+			Iat:   time.Now().Unix(),
+			Exp:   time.Now().Unix() + 7200,
+			Jti:   "rand",
+			Roles: []string{"root"},
 		}, nil},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			token, err := genToken(tt.tk, privKey)
+			token, err := genToken(tt.claims, keys.Active())
 			assert.Nil(t, err)
 			t.Logf("token: %s", token)
 
-			user := &entity.User{
-				Password: tt.tk.Password,
-			}
-			err = checkToken(token, user, pubKey)
+			claims, err := parseToken(token, keys)
 			assert.Equal(t, tt.err, err)
+			if err == nil {
+				assert.Equal(t, tt.claims, claims)
+			}
 		})
 	}
 
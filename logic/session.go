@@ -0,0 +1,116 @@
+package logic
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/carterdings/authentication/repo/log"
+)
+
+// ListSessions active sessions of the user, newest first
+func (s *service) ListSessions(req *entity.SessionReq) (*entity.SessionRsp, error) {
+	rsp := &entity.SessionRsp{}
+	claims, userName, err := s.sessionOwner(req)
+	if err != nil {
+		return rsp, err
+	}
+	rsp.Sessions = make([]*entity.Session, 0)
+	for _, f := range userFamilies(userName) {
+		rsp.Sessions = append(rsp.Sessions, &entity.Session{
+			ID:         f.ID,
+			TokenID:    f.TokenID,
+			CreateTime: f.CreateTime,
+			IssueTime:  f.IssueTime,
+			ExpireTime: f.ExpireTime,
+			ClientIP:   f.ClientIP,
+			UserAgent:  f.UserAgent,
+			Current:    f.ID == claims.Sid,
+		})
+	}
+	sort.Slice(rsp.Sessions, func(i, j int) bool {
+		return rsp.Sessions[i].CreateTime > rsp.Sessions[j].CreateTime
+	})
+	return rsp, nil
+}
+
+// RevokeSession revoke the tokens of one session of the user
+func (s *service) RevokeSession(req *entity.SessionReq) error {
+	_, userName, err := s.sessionOwner(req)
+	if err != nil {
+		return err
+	}
+	family := &entity.TokenFamily{
+		ID: req.SessionID,
+	}
+	v, ok := dao.Get(family.Key())
+	if ok {
+		family, ok = v.(*entity.TokenFamily)
+	}
+	if !ok || req.SessionID == "" || family.UserName != userName {
+		return errs.New(entity.ErrCodeSessionNotExist, "Session not exist")
+	}
+	s.revokeFamily(family)
+	return nil
+}
+
+// RevokeAllSessions revoke every token of the user, logout everywhere
+func (s *service) RevokeAllSessions(req *entity.SessionReq) error {
+	_, userName, err := s.sessionOwner(req)
+	if err != nil {
+		return err
+	}
+	s.revokeUserTokens(userName)
+	log.Infof("All sessions of %s revoked", userName)
+	return nil
+}
+
+// sessionOwner verify the caller token and return the user whose sessions are acted on,
+// callers act on their own sessions unless they are admins
+func (s *service) sessionOwner(req *entity.SessionReq) (*entity.Claims, string, error) {
+	caller := &entity.UserRoleReq{
+		Token: req.Token,
+	}
+	claims, err := s.checkToken(caller)
+	if err != nil {
+		return nil, "", err
+	}
+	if req.UserName == "" || req.UserName == caller.UserName {
+		return claims, caller.UserName, nil
+	}
+	if !hasRole(caller.UserName, entity.AdminRole, "") {
+		log.Errorf("Permission denied to %s on sessions of %s", caller.UserName, req.UserName)
+		return nil, "", errs.New(entity.ErrCodePermissionDenied, "Permission denied")
+	}
+	_, ok := dao.Get((&entity.User{UserName: req.UserName}).Key())
+	if !ok {
+		return nil, "", errs.New(entity.ErrCodeUserNotExist, "User not exist")
+	}
+	return claims, req.UserName, nil
+}
+
+// userFamilies token families of the user still alive
+func userFamilies(userName string) []*entity.TokenFamily {
+	user := &entity.User{
+		UserName: userName,
+	}
+	ut, _ := dao.Get(user.TokensKey())
+	tokens, _ := ut.(map[string]bool)
+	families := make([]*entity.TokenFamily, 0)
+	prefix := (&entity.TokenFamily{}).Key()
+	for key := range tokens {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		v, ok := dao.Get(key)
+		if !ok {
+			continue
+		}
+		if f, ok := v.(*entity.TokenFamily); ok {
+			families = append(families, f)
+		}
+	}
+	return families
+}
@@ -0,0 +1,80 @@
+package logic
+
+import (
+	"testing"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_AuthService_Sessions ...
+func Test_AuthService_Sessions(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s := NewServie(privKey, pubKey)
+
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "session", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "session"})
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "session_other", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "session_other"})
+	laptop, err := s.Authenticate(&entity.UserRoleReq{UserName: "session", Password: "pwd", ClientIP: "10.0.0.1", UserAgent: "laptop"})
+	assert.Nil(t, err)
+	phone, err := s.Authenticate(&entity.UserRoleReq{UserName: "session", Password: "pwd", ClientIP: "10.0.0.2", UserAgent: "phone"})
+	assert.Nil(t, err)
+	other, err := s.Authenticate(&entity.UserRoleReq{UserName: "session_other", Password: "pwd"})
+	assert.Nil(t, err)
+	// refreshing stays in the same session, seen from where it was refreshed last
+	phone, err = s.Refresh(&entity.UserRoleReq{RefreshToken: phone.RefreshToken, ClientIP: "10.0.0.3", UserAgent: "phone"})
+	assert.Nil(t, err)
+
+	rsp, err := s.ListSessions(&entity.SessionReq{Token: laptop.Token})
+	assert.Nil(t, err)
+	assert.Len(t, rsp.Sessions, 2)
+	sessions := make(map[string]*entity.Session)
+	for _, sess := range rsp.Sessions {
+		sessions[sess.UserAgent] = sess
+	}
+	assert.Equal(t, "10.0.0.1", sessions["laptop"].ClientIP)
+	assert.True(t, sessions["laptop"].Current)
+	assert.Equal(t, "10.0.0.3", sessions["phone"].ClientIP)
+	assert.False(t, sessions["phone"].Current)
+	claims, err := parseToken(phone.Token, s.(*service).keys)
+	assert.Nil(t, err)
+	assert.Equal(t, claims.Jti, sessions["phone"].TokenID)
+	assert.Equal(t, claims.Sid, sessions["phone"].ID)
+
+	tests := []struct {
+		name string
+		req  *entity.SessionReq
+		err  error
+	}{
+		{"test_unknown", &entity.SessionReq{Token: laptop.Token, SessionID: "unknown"}, errs.New(entity.ErrCodeSessionNotExist, "Session not exist")},
+		{"test_not_owner", &entity.SessionReq{Token: other.Token, SessionID: sessions["phone"].ID}, errs.New(entity.ErrCodeSessionNotExist, "Session not exist")},
+		{"test_other_user", &entity.SessionReq{Token: other.Token, UserName: "session", SessionID: sessions["phone"].ID}, errs.New(entity.ErrCodePermissionDenied, "Permission denied")},
+		{"test_revoke", &entity.SessionReq{Token: laptop.Token, SessionID: sessions["phone"].ID}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.RevokeSession(tt.req)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+	_, err = s.AllRoles(&entity.UserRoleReq{Token: phone.Token})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidToken, "Invalid token: invalidated"), err)
+	_, err = s.Refresh(&entity.UserRoleReq{RefreshToken: phone.RefreshToken})
+	assert.NotNil(t, err)
+	rsp, err = s.ListSessions(&entity.SessionReq{Token: laptop.Token})
+	assert.Nil(t, err)
+	assert.Len(t, rsp.Sessions, 1)
+
+	// logout everywhere
+	assert.Nil(t, s.RevokeAllSessions(&entity.SessionReq{Token: laptop.Token}))
+	_, err = s.ListSessions(&entity.SessionReq{Token: laptop.Token})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidToken, "Invalid token: invalidated"), err)
+	_, err = s.Refresh(&entity.UserRoleReq{RefreshToken: laptop.RefreshToken})
+	assert.NotNil(t, err)
+	rsp, err = s.ListSessions(&entity.SessionReq{Token: other.Token})
+	assert.Nil(t, err)
+	assert.Len(t, rsp.Sessions, 1)
+}
@@ -0,0 +1,296 @@
+package logic
+
+import (
+	"encoding/base64"
+	"sort"
+	"time"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/carterdings/authentication/repo/log"
+)
+
+// Refresh exchange a refresh token for a new access token and refresh token.
+// Each refresh token is single-use, presenting a rotated one again revokes the whole family.
+func (s *service) Refresh(req *entity.UserRoleReq) (*entity.UserRoleRsp, error) {
+	rsp := &entity.UserRoleRsp{}
+	if req.RefreshToken == "" {
+		return rsp, errs.New(entity.ErrCodeInvalidParam, "Empty refresh token")
+	}
+	rt := &entity.RefreshToken{
+		Token: req.RefreshToken,
+	}
+	s.refreshLock.Lock()
+	defer s.refreshLock.Unlock()
+
+	v, ok := dao.Get(rt.Key())
+	if !ok {
+		return rsp, errs.New(entity.ErrCodeInvalidToken, "Invalid refresh token")
+	}
+	rt, ok = v.(*entity.RefreshToken)
+	if !ok {
+		return rsp, errs.New(entity.ErrCodeInvalidToken, "Invalid refresh token")
+	}
+	family := &entity.TokenFamily{
+		ID: rt.FamilyID,
+	}
+	v, ok = dao.Get(family.Key())
+	if ok {
+		family, ok = v.(*entity.TokenFamily)
+	}
+	if rt.Used {
+		// a rotated refresh token shows up again, someone else may hold the family
+		log.Errorf("Refresh token of family %s reused by %s", rt.FamilyID, rt.UserName)
+		if ok {
+			s.revokeFamily(family)
+		}
+		return rsp, errs.New(entity.ErrCodeReusedToken, "Refresh token reused")
+	}
+	if !ok {
+		// the session is gone, signed out or revoked
+		return rsp, errs.New(entity.ErrCodeInvalidToken, "Invalid refresh token")
+	}
+
+	user := &entity.User{
+		UserName: rt.UserName,
+	}
+	u, ok := dao.Get(user.Key())
+	if !ok {
+		return rsp, errs.New(entity.ErrCodeUserNotExist, "User not exist")
+	}
+	usr, ok := u.(*entity.User)
+	if !ok {
+		return rsp, errs.New(entity.ErrCodeUserNotExist, "User not exist")
+	}
+
+	remain := rt.CreateTime + rt.Expire - time.Now().Unix()
+	if remain <= 0 {
+		return rsp, errs.New(entity.ErrCodeExpiredToken, "Expired refresh token")
+	}
+	// the session shows where it was refreshed last
+	latest := *family
+	if req.ClientIP != "" {
+		latest.ClientIP = req.ClientIP
+		latest.UserAgent = req.UserAgent
+	}
+	// issue first, a failure leaves the token unused for the client to retry
+	rsp, err := s.issueTokens(usr, &latest)
+	if err != nil {
+		return rsp, err
+	}
+	// mark used, it is kept until expiry to detect reuse
+	used := *rt
+	used.Used = true
+	dao.Set(used.Key(), &used, time.Duration(remain)*time.Second)
+	return rsp, nil
+}
+
+// newFamily new token family, the session started by an authentication
+func newFamily(userName string, req *entity.UserRoleReq) *entity.TokenFamily {
+	return &entity.TokenFamily{
+		ID:         randString(16),
+		UserName:   userName,
+		CreateTime: time.Now().Unix(),
+		ClientIP:   req.ClientIP,
+		UserAgent:  req.UserAgent,
+	}
+}
+
+// issueTokens issue an access token, a JWT or an opaque one, and a refresh token of the family
+func (s *service) issueTokens(usr *entity.User, family *entity.TokenFamily) (*entity.UserRoleRsp, error) {
+	rsp := &entity.UserRoleRsp{}
+	now := time.Now().Unix()
+	// generate token
+	claims := &entity.Claims{
+		Sub:   usr.UserName,
+		Iat:   now,
+		Exp:   now + entity.TokenExpire,
+		Jti:   randString(16),
+		Sid:   family.ID,
+		Cv:    usr.CredVersion,
+		Roles: userRoles(usr.UserName),
+	}
+	var token string
+	if s.tokenFormat == TokenOpaque {
+		token = randString(32)
+		claims.Jti = opaqueID(token)
+	} else {
+		var err error
+		token, err = genToken(claims, s.keys.Active())
+		if err != nil {
+			return rsp, errs.Newf(entity.ErrCodeGenToken, "generate token: %v", err)
+		}
+	}
+
+	rt := &entity.RefreshToken{
+		Token:      randString(32),
+		UserName:   usr.UserName,
+		FamilyID:   family.ID,
+		CreateTime: now,
+		Expire:     entity.RefreshTokenExpire,
+	}
+	// keep the keys still alive, used refresh tokens stay for reuse detection
+	f := *family
+	f.Keys = nil
+	for _, k := range family.Keys {
+		if _, ok := dao.Get(k); ok {
+			f.Keys = append(f.Keys, k)
+		}
+	}
+	f.Keys = append(f.Keys, claims.Key(), rt.Key())
+	f.TokenID = claims.Jti
+	f.IssueTime = now
+	f.ExpireTime = now + entity.RefreshTokenExpire
+
+	dao.Set(claims.Key(), claims, time.Duration(entity.TokenExpire)*time.Second)
+	dao.Set(rt.Key(), rt, time.Duration(entity.RefreshTokenExpire)*time.Second)
+	dao.Set(f.Key(), &f, time.Duration(entity.RefreshTokenExpire)*time.Second)
+
+	// index the tokens so that they can be revoked with the user
+	user := &entity.User{
+		UserName: usr.UserName,
+	}
+	s.tokenLock.Lock()
+	_, ok := dao.Get(user.Key())
+	if !ok {
+		// deleted meanwhile
+		s.tokenLock.Unlock()
+		s.revokeFamily(&f)
+		return rsp, errs.New(entity.ErrCodeUserNotExist, "User not exist")
+	}
+	pruneTokens(user.TokensKey())
+	addToSet(user.TokensKey(), claims.Key())
+	addToSet(user.TokensKey(), rt.Key())
+	addToSet(user.TokensKey(), f.Key())
+	s.tokenLock.Unlock()
+
+	rsp.Token = token
+	rsp.RefreshToken = rt.Token
+	return rsp, nil
+}
+
+// revokeUserTokens revoke every token issued to the user, all its sessions
+func (s *service) revokeUserTokens(userName string) {
+	user := &entity.User{
+		UserName: userName,
+	}
+	s.tokenLock.Lock()
+	ut, _ := dao.Get(user.TokensKey())
+	tokens, _ := ut.(map[string]bool)
+	for token := range tokens {
+		dao.Delete(token)
+	}
+	dao.Delete(user.TokensKey())
+	s.tokenLock.Unlock()
+}
+
+// revokeFamily revoke every access and refresh token of the family
+func (s *service) revokeFamily(family *entity.TokenFamily) {
+	user := &entity.User{
+		UserName: family.UserName,
+	}
+	s.tokenLock.Lock()
+	for _, k := range family.Keys {
+		dao.Delete(k)
+		removeFromSet(user.TokensKey(), k)
+	}
+	dao.Delete(family.Key())
+	removeFromSet(user.TokensKey(), family.Key())
+	s.tokenLock.Unlock()
+}
+
+// userRoles sorted roles directly bound to the user and active now, role@resource for scoped bindings
+func userRoles(userName string) []string {
+	rlist := make([]string, 0)
+	for _, entry := range storedRoles(userName) {
+		roleName, resource := splitScope(entry)
+		bind := &entity.UserRoleReq{
+			UserName: userName,
+			RoleName: roleName,
+			Resource: resource,
+		}
+		if bindActive(bind) {
+			rlist = append(rlist, entry)
+		}
+	}
+	return rlist
+}
+
+// storedRoles sorted entries of the user roles set, including bindings expired or not active yet
+func storedRoles(userName string) []string {
+	user := &entity.User{
+		UserName: userName,
+	}
+	ur, _ := dao.Get(user.UserRolesKey())
+	roles, _ := ur.(map[string]bool)
+	rlist := make([]string, 0, len(roles))
+	for k := range roles {
+		rlist = append(rlist, k)
+	}
+	sort.Strings(rlist)
+	return rlist
+}
+
+// bindActive whether the user roles hold the binding and it counts now, bindings stored without times
+// always count. A record found at the bind key only counts if it binds this very user and role.
+func bindActive(bind *entity.UserRoleReq) bool {
+	ur, _ := dao.Get((&entity.User{UserName: bind.UserName}).UserRolesKey())
+	roles, _ := ur.(map[string]bool)
+	if !roles[bind.ScopedRole()] {
+		return false
+	}
+	v, ok := dao.Get(bind.Key())
+	if !ok {
+		return false
+	}
+	b, _ := v.(*entity.Binding)
+	if b == nil {
+		return true
+	}
+	if b.UserName != bind.UserName || b.RoleName != bind.RoleName || b.Resource != bind.Resource {
+		log.Errorf("Binding at %s is of user %s role %s, not of user %s role %s",
+			bind.Key(), b.UserName, b.RoleName, bind.UserName, bind.RoleName)
+		return false
+	}
+	return b.Active(time.Now().Unix())
+}
+
+// pruneRoles drop the bindings purged by the store from the user roles and the reverse index,
+// called with the bind lock held
+func pruneRoles(userName string) {
+	user := &entity.User{
+		UserName: userName,
+	}
+	for _, entry := range storedRoles(userName) {
+		roleName, resource := splitScope(entry)
+		bind := &entity.UserRoleReq{
+			UserName: userName,
+			RoleName: roleName,
+			Resource: resource,
+		}
+		if _, ok := dao.Get(bind.Key()); ok {
+			continue
+		}
+		removeFromSet(user.UserRolesKey(), entry)
+		if !roleBound(userName, roleName) {
+			removeFromSet((&entity.Role{RoleName: roleName}).UsersKey(), userName)
+		}
+	}
+}
+
+// roleBound whether the user roles hold the role in some scope, the reverse index keeps the user meanwhile
+func roleBound(userName, roleName string) bool {
+	for _, entry := range storedRoles(userName) {
+		if r, _ := splitScope(entry); r == roleName {
+			return true
+		}
+	}
+	return false
+}
+
+func randString(n int) string {
+	buf := make([]byte, n)
+	randBytes(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,88 @@
+package logic
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_AuthService_Refresh ...
+func Test_AuthService_Refresh(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s := NewServie(privKey, pubKey)
+
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "refresh", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "refresh"})
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "refresh", Password: "pwd"})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, rsp.RefreshToken)
+	first := rsp.RefreshToken
+
+	// rotate
+	rsp, err = s.Refresh(&entity.UserRoleReq{RefreshToken: first})
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, rsp.RefreshToken)
+	second := rsp
+	_, err = s.AllRoles(&entity.UserRoleReq{UserName: "refresh", Token: second.Token})
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name string
+		req  *entity.UserRoleReq
+		err  error
+	}{
+		{"test_1", &entity.UserRoleReq{}, errs.New(entity.ErrCodeInvalidParam, "Empty refresh token")},
+		{"test_2", &entity.UserRoleReq{RefreshToken: "unknown"}, errs.New(entity.ErrCodeInvalidToken, "Invalid refresh token")},
+		// reuse of the rotated token revokes the family
+		{"test_3", &entity.UserRoleReq{RefreshToken: first}, errs.New(entity.ErrCodeReusedToken, "Refresh token reused")},
+		{"test_4", &entity.UserRoleReq{RefreshToken: second.RefreshToken}, errs.New(entity.ErrCodeInvalidToken, "Invalid refresh token")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Refresh(tt.req)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+
+	_, err = s.AllRoles(&entity.UserRoleReq{UserName: "refresh", Token: second.Token})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidToken, "Invalid token: invalidated"), err)
+
+	// other families are not affected
+	rsp, err = s.Authenticate(&entity.UserRoleReq{UserName: "refresh", Password: "pwd"})
+	assert.Nil(t, err)
+	rsp, err = s.Refresh(&entity.UserRoleReq{RefreshToken: rsp.RefreshToken})
+	assert.Nil(t, err)
+
+	// a refresh that fails to issue leaves the token for a retry
+	key := s.(*service).keys.Active()
+	signer := key.Signer
+	key.Signer = failingSigner{signer}
+	_, err = s.Refresh(&entity.UserRoleReq{RefreshToken: rsp.RefreshToken})
+	assert.Equal(t, entity.ErrCodeGenToken, errs.ErrCode(err))
+	key.Signer = signer
+	rsp, err = s.Refresh(&entity.UserRoleReq{RefreshToken: rsp.RefreshToken})
+	assert.Nil(t, err)
+
+	// the refresh token of a family gone is invalid, not reused
+	v, ok := dao.Get((&entity.RefreshToken{Token: rsp.RefreshToken}).Key())
+	assert.True(t, ok)
+	dao.Delete((&entity.TokenFamily{ID: v.(*entity.RefreshToken).FamilyID}).Key())
+	_, err = s.Refresh(&entity.UserRoleReq{RefreshToken: rsp.RefreshToken})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidToken, "Invalid refresh token"), err)
+}
+
+// failingSigner signer failing to sign
+type failingSigner struct {
+	Signer
+}
+
+// Sign fail
+func (failingSigner) Sign(data []byte) ([]byte, error) {
+	return nil, errors.New("sign failed")
+}
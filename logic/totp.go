@@ -0,0 +1,262 @@
+package logic
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/carterdings/authentication/repo/log"
+)
+
+// TOTP parameters, RFC 6238 defaults understood by every authenticator app
+const (
+	totpIssuer    = "authentication"
+	totpSecretLen = 20
+	totpDigits    = 6
+	totpPeriod    = 30
+	// totpSkew time steps accepted before and after the current one
+	totpSkew = 1
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// EnrollTOTP generate a TOTP secret for the token user, it is used once confirmed with a code
+func (s *service) EnrollTOTP(req *entity.MFAReq) (*entity.MFARsp, error) {
+	rsp := &entity.MFARsp{}
+	ureq := &entity.UserRoleReq{
+		Token: req.Token,
+	}
+	_, err := s.checkToken(ureq)
+	if err != nil {
+		return rsp, err
+	}
+	secret := make([]byte, totpSecretLen)
+	randBytes(secret)
+	_, err = s.updateUser(ureq.UserName, func(usr *entity.User) error {
+		if usr.TOTPEnabled {
+			return errs.New(entity.ErrCodeMFAConflict, "MFA already enabled")
+		}
+		usr.TOTPSecret = secret
+		usr.TOTPCounter = 0
+		return nil
+	})
+	if err != nil {
+		return rsp, err
+	}
+	rsp.Secret = b32.EncodeToString(secret)
+	rsp.URI = totpURI(ureq.UserName, secret)
+	return rsp, nil
+}
+
+// ConfirmTOTP enable TOTP with a code of the enrolled secret, recovery codes are generated along
+func (s *service) ConfirmTOTP(req *entity.MFAReq) (*entity.MFARsp, error) {
+	rsp := &entity.MFARsp{}
+	ureq := &entity.UserRoleReq{
+		Token: req.Token,
+	}
+	_, err := s.checkToken(ureq)
+	if err != nil {
+		return rsp, err
+	}
+	codes, hashes := newRecoveryCodes()
+	_, err = s.updateUser(ureq.UserName, func(usr *entity.User) error {
+		if usr.TOTPEnabled {
+			return errs.New(entity.ErrCodeMFAConflict, "MFA already enabled")
+		}
+		if len(usr.TOTPSecret) == 0 {
+			return errs.New(entity.ErrCodeMFAConflict, "MFA not enrolled")
+		}
+		err := useTOTP(usr, req.Code)
+		if err != nil {
+			return err
+		}
+		usr.TOTPEnabled = true
+		usr.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		return rsp, err
+	}
+	log.Infof("MFA of %s enabled", ureq.UserName)
+	rsp.RecoveryCodes = codes
+	rsp.Remaining = len(codes)
+	return rsp, nil
+}
+
+// DisableTOTP turn TOTP off, proven with a current code or a recovery code
+func (s *service) DisableTOTP(req *entity.MFAReq) error {
+	ureq := &entity.UserRoleReq{
+		Token: req.Token,
+	}
+	_, err := s.checkToken(ureq)
+	if err != nil {
+		return err
+	}
+	_, err = s.updateWithSecondFactor(ureq.UserName, req.ClientIP, req.Code, func(usr *entity.User) {
+		usr.TOTPEnabled = false
+		usr.TOTPSecret = nil
+		usr.TOTPCounter = 0
+		usr.RecoveryCodes = nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("MFA of %s disabled", ureq.UserName)
+	return nil
+}
+
+// CompleteMFA complete an authentication challenge with a TOTP code or a recovery code and issue the tokens
+func (s *service) CompleteMFA(req *entity.MFAReq) (*entity.UserRoleRsp, error) {
+	rsp := &entity.UserRoleRsp{}
+	mc := &entity.MFAChallenge{
+		ID: req.MFAToken,
+	}
+	s.mfaLock.Lock()
+	v, ok := dao.Get(mc.Key())
+	if ok {
+		mc, ok = v.(*entity.MFAChallenge)
+	}
+	if !ok || req.MFAToken == "" {
+		s.mfaLock.Unlock()
+		return rsp, errs.New(entity.ErrCodeInvalidToken, "Invalid mfa token")
+	}
+	usr, err := s.updateWithSecondFactor(mc.UserName, mc.ClientIP, req.Code, nil)
+	if err != nil {
+		if errs.ErrCode(err) == entity.ErrCodeInvalidOTP {
+			failChallenge(mc)
+		}
+		s.mfaLock.Unlock()
+		return rsp, err
+	}
+	// single-use
+	dao.Delete(mc.Key())
+	s.mfaLock.Unlock()
+	s.clearFailures(usr.UserName)
+
+	family := newFamily(usr.UserName, &entity.UserRoleReq{ClientIP: mc.ClientIP, UserAgent: mc.UserAgent})
+	return s.issueTokens(usr, family)
+}
+
+// updateWithSecondFactor apply update to the user once code proves its second factor,
+// a wrong code counts as a failed login
+func (s *service) updateWithSecondFactor(userName, clientIP, code string,
+	update func(usr *entity.User)) (*entity.User, error) {
+	err := s.reserveAttempt(userName, clientIP)
+	if err != nil {
+		return nil, err
+	}
+	usr, err := s.updateUser(userName, func(usr *entity.User) error {
+		if !usr.TOTPEnabled {
+			return errs.New(entity.ErrCodeMFAConflict, "MFA not enabled")
+		}
+		err := useSecondFactor(usr, code)
+		if err != nil {
+			return err
+		}
+		if update != nil {
+			update(usr)
+		}
+		return nil
+	})
+	if errs.ErrCode(err) != entity.ErrCodeInvalidOTP {
+		s.releaseAttempt(userName, clientIP)
+	}
+	return usr, err
+}
+
+// newChallenge start the second factor step of an authentication
+func newChallenge(usr *entity.User, req *entity.UserRoleReq) *entity.UserRoleRsp {
+	mc := &entity.MFAChallenge{
+		ID:         randString(24),
+		UserName:   usr.UserName,
+		ClientIP:   req.ClientIP,
+		UserAgent:  req.UserAgent,
+		CreateTime: time.Now().Unix(),
+	}
+	dao.Set(mc.Key(), mc, time.Duration(entity.MFAChallengeExpire)*time.Second)
+	return &entity.UserRoleRsp{
+		MFAPending: true,
+		MFAToken:   mc.ID,
+	}
+}
+
+// failChallenge count a wrong code, the challenge is dropped after a few
+func failChallenge(mc *entity.MFAChallenge) {
+	failed := *mc
+	failed.Attempts++
+	remain := failed.CreateTime + entity.MFAChallengeExpire - time.Now().Unix()
+	if failed.Attempts >= entity.MFAAttempts || remain <= 0 {
+		dao.Delete(mc.Key())
+		return
+	}
+	dao.Set(failed.Key(), &failed, time.Duration(remain)*time.Second)
+}
+
+// useTOTP check code against the secret of usr and record its time step so that it cannot be replayed
+func useTOTP(usr *entity.User, code string) error {
+	counter, ok := verifyTOTP(usr.TOTPSecret, code, time.Now(), usr.TOTPCounter)
+	if !ok {
+		log.Errorf("Invalid TOTP code for %s", usr.UserName)
+		return errs.New(entity.ErrCodeInvalidOTP, "Invalid code")
+	}
+	usr.TOTPCounter = counter
+	return nil
+}
+
+// verifyTOTP time step of the code if valid around now and later than the last one used
+func verifyTOTP(secret []byte, code string, now time.Time, last int64) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if counter <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode HOTP value of counter, RFC 4226
+func totpCode(secret []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// totpURI otpauth:// provisioning URI, usually shown as a QR code
+func totpURI(userName string, secret []byte) string {
+	v := url.Values{}
+	v.Set("secret", b32.EncodeToString(secret))
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + userName,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
@@ -0,0 +1,123 @@
+package logic
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_totpCode RFC 6238 appendix B, SHA1
+func Test_totpCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.code, totpCode(secret, tt.unix/totpPeriod))
+	}
+
+	now := time.Unix(1111111109, 0)
+	step := now.Unix() / totpPeriod
+	counter, ok := verifyTOTP(secret, "081804", now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, step, counter)
+	// used already
+	_, ok = verifyTOTP(secret, "081804", now, step)
+	assert.False(t, ok)
+	// one step of clock drift
+	_, ok = verifyTOTP(secret, totpCode(secret, step+1), now, 0)
+	assert.True(t, ok)
+	_, ok = verifyTOTP(secret, totpCode(secret, step+2), now, 0)
+	assert.False(t, ok)
+	_, ok = verifyTOTP(secret, "81804", now, 0)
+	assert.False(t, ok)
+}
+
+// Test_AuthService_TOTP ...
+func Test_AuthService_TOTP(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s := NewServie(privKey, pubKey)
+	svc := s.(*service)
+
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "twofactor", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "twofactor"})
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "twofactor", Password: "pwd"})
+	assert.Nil(t, err)
+	token := rsp.Token
+
+	enroll, err := s.EnrollTOTP(&entity.MFAReq{Token: token})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(enroll.URI, "otpauth://totp/authentication:twofactor?"))
+	secret, err := b32.DecodeString(enroll.Secret)
+	assert.Nil(t, err)
+	step := time.Now().Unix() / totpPeriod
+
+	// not enabled before confirmed
+	rsp, err = s.Authenticate(&entity.UserRoleReq{UserName: "twofactor", Password: "pwd"})
+	assert.Nil(t, err)
+	assert.False(t, rsp.MFAPending)
+	_, err = s.ConfirmTOTP(&entity.MFAReq{Token: token, Code: "000000"})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidOTP, "Invalid code"), err)
+	confirm, err := s.ConfirmTOTP(&entity.MFAReq{Token: token, Code: totpCode(secret, step)})
+	assert.Nil(t, err)
+	assert.Len(t, confirm.RecoveryCodes, entity.RecoveryCodeCount)
+	_, err = s.EnrollTOTP(&entity.MFAReq{Token: token})
+	assert.Equal(t, errs.New(entity.ErrCodeMFAConflict, "MFA already enabled"), err)
+
+	rsp, err = s.Authenticate(&entity.UserRoleReq{UserName: "twofactor", Password: "pwd"})
+	assert.Nil(t, err)
+	assert.True(t, rsp.MFAPending)
+	assert.Empty(t, rsp.Token)
+	mfaToken := rsp.MFAToken
+
+	_, err = s.CompleteMFA(&entity.MFAReq{MFAToken: "bad", Code: totpCode(secret, step+1)})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidToken, "Invalid mfa token"), err)
+	// replayed
+	_, err = s.CompleteMFA(&entity.MFAReq{MFAToken: mfaToken, Code: totpCode(secret, step)})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidOTP, "Invalid code"), err)
+	rsp, err = s.CompleteMFA(&entity.MFAReq{MFAToken: mfaToken, Code: totpCode(secret, step+1)})
+	assert.Nil(t, err)
+	_, err = s.AllRoles(&entity.UserRoleReq{Token: rsp.Token})
+	assert.Nil(t, err)
+	// single-use
+	_, err = s.CompleteMFA(&entity.MFAReq{MFAToken: mfaToken, Code: totpCode(secret, step+1)})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidToken, "Invalid mfa token"), err)
+
+	// dropped after too many wrong codes, the lockout is tested apart
+	assert.Nil(t, s.Unlock(&entity.LockoutReq{UserName: "twofactor"}))
+	rsp, err = s.Authenticate(&entity.UserRoleReq{UserName: "twofactor", Password: "pwd"})
+	assert.Nil(t, err)
+	for i := 0; i < entity.MFAAttempts; i++ {
+		_, err = s.CompleteMFA(&entity.MFAReq{MFAToken: rsp.MFAToken, Code: "000000"})
+		assert.Equal(t, errs.New(entity.ErrCodeInvalidOTP, "Invalid code"), err)
+	}
+	rewind := func(usr *entity.User) error {
+		usr.TOTPCounter = 0
+		return nil
+	}
+	_, err = svc.updateUser("twofactor", rewind)
+	assert.Nil(t, err)
+	_, err = s.CompleteMFA(&entity.MFAReq{MFAToken: rsp.MFAToken, Code: totpCode(secret, step)})
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidToken, "Invalid mfa token"), err)
+
+	assert.Nil(t, s.Unlock(&entity.LockoutReq{UserName: "twofactor"}))
+	assert.Nil(t, s.DisableTOTP(&entity.MFAReq{Token: token, Code: totpCode(secret, step)}))
+	err = s.DisableTOTP(&entity.MFAReq{Token: token, Code: totpCode(secret, step+1)})
+	assert.Equal(t, errs.New(entity.ErrCodeMFAConflict, "MFA not enabled"), err)
+	rsp, err = s.Authenticate(&entity.UserRoleReq{UserName: "twofactor", Password: "pwd"})
+	assert.Nil(t, err)
+	assert.False(t, rsp.MFAPending)
+	assert.NotEmpty(t, rsp.Token)
+}
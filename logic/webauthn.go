@@ -0,0 +1,578 @@
+package logic
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/carterdings/authentication/repo/log"
+	"github.com/patrickmn/go-cache"
+)
+
+// COSE algorithms of the credential public keys, RFC 9053
+const (
+	coseES256 = -7
+	coseRS256 = -257
+)
+
+// WebAuthn relying party defaults
+const (
+	rpName          = "authentication"
+	defaultRPID     = "localhost"
+	defaultRPOrigin = "http://localhost:8080"
+)
+
+// client data types of the ceremonies
+const (
+	webauthnCreate = "webauthn.create"
+	webauthnGet    = "webauthn.get"
+)
+
+// authenticator data flags
+const (
+	flagUP = 0x01
+	flagAT = 0x40
+	flagED = 0x80
+)
+
+// oidAAGUID id-fido-gen-ce-aaguid extension of packed attestation certificates
+var oidAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// BeginRegistration start registering a WebAuthn credential for the token user
+func (s *service) BeginRegistration(req *entity.WebAuthnReq) (*entity.WebAuthnRsp, error) {
+	rsp := &entity.WebAuthnRsp{}
+	ureq := &entity.UserRoleReq{
+		Token: req.Token,
+	}
+	_, err := s.checkToken(ureq)
+	if err != nil {
+		return rsp, err
+	}
+	wc := newWebAuthnChallenge(webauthnCreate, ureq.UserName)
+	rsp.Options = &entity.PublicKeyOptions{
+		Challenge: wc.Challenge,
+		RP: &entity.RelyingParty{
+			ID:   s.rpID,
+			Name: rpName,
+		},
+		User: &entity.WebAuthnUser{
+			ID:          base64.RawURLEncoding.EncodeToString(userHandle(ureq.UserName)),
+			Name:        ureq.UserName,
+			DisplayName: ureq.UserName,
+		},
+		PubKeyCredParams: []*entity.CredentialParam{
+			{Type: "public-key", Alg: coseES256},
+			{Type: "public-key", Alg: coseRS256},
+		},
+		ExcludeCredentials: credentialDescs(ureq.UserName),
+		Timeout:            entity.WebAuthnChallengeExpire * 1000,
+		Attestation:        "none",
+		UserVerification:   "preferred",
+	}
+	return rsp, nil
+}
+
+// FinishRegistration verify the attestation of a new credential of the token user and store it
+func (s *service) FinishRegistration(req *entity.WebAuthnReq) (*entity.WebAuthnRsp, error) {
+	rsp := &entity.WebAuthnRsp{}
+	ureq := &entity.UserRoleReq{
+		Token: req.Token,
+	}
+	_, err := s.checkToken(ureq)
+	if err != nil {
+		return rsp, err
+	}
+	wc, clientData, err := s.verifyClientData(req.ClientDataJSON, webauthnCreate)
+	if err != nil {
+		return rsp, err
+	}
+	if wc.UserName != ureq.UserName {
+		return rsp, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: challenge of another user")
+	}
+	raw, err := decodeB64URL(req.AttestationObject)
+	if err != nil {
+		return rsp, errs.Newf(entity.ErrCodeInvalidCredential, "Invalid credential: %v", err)
+	}
+	v, _, err := cborDecode(raw)
+	if err != nil {
+		return rsp, errs.Newf(entity.ErrCodeInvalidCredential, "Invalid credential: %v", err)
+	}
+	att, _ := v.(map[interface{}]interface{})
+	format, _ := att["fmt"].(string)
+	rawAuthData, _ := att["authData"].([]byte)
+	stmt, ok := att["attStmt"].(map[interface{}]interface{})
+	if !ok {
+		return rsp, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: malformed attestation")
+	}
+	ad, err := s.parseAuthData(rawAuthData)
+	if err != nil {
+		return rsp, err
+	}
+	if ad.flags&flagAT == 0 {
+		return rsp, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: no attested credential data")
+	}
+	if req.ID != "" && req.ID != base64.RawURLEncoding.EncodeToString(ad.credID) {
+		return rsp, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: id mismatch")
+	}
+	alg, pub, err := parseCOSEKey(ad.credKey)
+	if err != nil {
+		return rsp, errs.Newf(entity.ErrCodeInvalidCredential, "Invalid credential: %v", err)
+	}
+	clientDataHash := sha256.Sum256(clientData)
+	err = verifyAttestation(format, stmt, rawAuthData, clientDataHash[:], alg, pub, ad.aaguid)
+	if err != nil {
+		return rsp, errs.Newf(entity.ErrCodeInvalidCredential, "Invalid credential: %v", err)
+	}
+
+	cred := &entity.WebAuthnCredential{
+		ID:         base64.RawURLEncoding.EncodeToString(ad.credID),
+		UserName:   ureq.UserName,
+		PublicKey:  ad.credKey,
+		Alg:        alg,
+		SignCount:  ad.signCount,
+		AAGUID:     ad.aaguid,
+		Format:     format,
+		CreateTime: time.Now().Unix(),
+	}
+	user := &entity.User{
+		UserName: ureq.UserName,
+	}
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+	if _, ok := dao.Get(user.Key()); !ok {
+		return rsp, errs.New(entity.ErrCodeUserNotExist, "User not exist")
+	}
+	if _, ok := dao.Get(cred.Key()); ok {
+		return rsp, errs.New(entity.ErrCodeCredentialExists, "Credential exists")
+	}
+	dao.Set(cred.Key(), cred, cache.NoExpiration)
+	addToSet(user.CredentialsKey(), cred.ID)
+	log.Infof("WebAuthn credential %s of %s registered, %s attestation", cred.ID, cred.UserName, format)
+	rsp.ID = cred.ID
+	return rsp, nil
+}
+
+// BeginLogin start a WebAuthn login of the named user, or of any discoverable credential if no user is named
+func (s *service) BeginLogin(req *entity.WebAuthnReq) (*entity.WebAuthnRsp, error) {
+	rsp := &entity.WebAuthnRsp{}
+	if req.UserName != "" {
+		if _, ok := dao.Get((&entity.User{UserName: req.UserName}).Key()); !ok {
+			return rsp, errs.New(entity.ErrCodeUserNotExist, "User not exist")
+		}
+	}
+	wc := newWebAuthnChallenge(webauthnGet, req.UserName)
+	rsp.Options = &entity.PublicKeyOptions{
+		Challenge:        wc.Challenge,
+		RPID:             s.rpID,
+		Timeout:          entity.WebAuthnChallengeExpire * 1000,
+		UserVerification: "preferred",
+	}
+	if req.UserName != "" {
+		rsp.Options.AllowCredentials = credentialDescs(req.UserName)
+	}
+	return rsp, nil
+}
+
+// FinishLogin verify the assertion of a registered credential and issue the tokens as Authenticate does.
+// Failed assertions count against the owner of the credential and the client IP as wrong passwords do.
+func (s *service) FinishLogin(req *entity.WebAuthnReq) (*entity.UserRoleRsp, error) {
+	rsp := &entity.UserRoleRsp{}
+	var userName string
+	if cred, err := loadCredential(req.ID); err == nil {
+		userName = cred.UserName
+	}
+	err := s.reserveAttempt(userName, req.ClientIP)
+	if err != nil {
+		return rsp, err
+	}
+	usr, err := s.verifyAssertion(req)
+	if err != nil {
+		return rsp, err
+	}
+	s.releaseAttempt(userName, req.ClientIP)
+	s.clearFailures(usr.UserName)
+
+	family := newFamily(usr.UserName, &entity.UserRoleReq{ClientIP: req.ClientIP, UserAgent: req.UserAgent})
+	return s.issueTokens(usr, family)
+}
+
+// verifyAssertion check the assertion of a registered credential, WebAuthn §7.2, and return its user
+func (s *service) verifyAssertion(req *entity.WebAuthnReq) (*entity.User, error) {
+	wc, clientData, err := s.verifyClientData(req.ClientDataJSON, webauthnGet)
+	if err != nil {
+		return nil, err
+	}
+	cred, err := loadCredential(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	if wc.UserName != "" && wc.UserName != cred.UserName {
+		return nil, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: challenge of another user")
+	}
+	if req.UserHandle != "" {
+		handle, err := decodeB64URL(req.UserHandle)
+		if err != nil || !bytes.Equal(handle, userHandle(cred.UserName)) {
+			return nil, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: user handle mismatch")
+		}
+	}
+	rawAuthData, err := decodeB64URL(req.AuthenticatorData)
+	if err != nil {
+		return nil, errs.Newf(entity.ErrCodeInvalidCredential, "Invalid credential: %v", err)
+	}
+	ad, err := s.parseAuthData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := decodeB64URL(req.Signature)
+	if err != nil {
+		return nil, errs.Newf(entity.ErrCodeInvalidCredential, "Invalid credential: %v", err)
+	}
+	_, pub, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return nil, errs.Newf(entity.ErrCodeInvalidCredential, "Invalid credential: %v", err)
+	}
+	clientDataHash := sha256.Sum256(clientData)
+	err = verifySignature(cred.Alg, pub, append(rawAuthData, clientDataHash[:]...), sig)
+	if err != nil {
+		log.Errorf("Invalid WebAuthn assertion of credential %s: %v", cred.ID, err)
+		return nil, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: bad signature")
+	}
+
+	// the counter only grows, unless the authenticator does not keep one
+	s.webauthnLock.Lock()
+	v, ok := dao.Get(cred.Key())
+	if ok {
+		cred, ok = v.(*entity.WebAuthnCredential)
+	}
+	if !ok {
+		s.webauthnLock.Unlock()
+		return nil, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: unknown credential")
+	}
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		s.webauthnLock.Unlock()
+		log.Errorf("Sign counter of credential %s went from %d to %d, authenticator may be cloned",
+			cred.ID, cred.SignCount, ad.signCount)
+		return nil, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: sign counter regressed")
+	}
+	used := *cred
+	used.SignCount = ad.signCount
+	dao.Set(used.Key(), &used, cache.NoExpiration)
+	s.webauthnLock.Unlock()
+
+	u, ok := dao.Get((&entity.User{UserName: cred.UserName}).Key())
+	if !ok {
+		return nil, errs.New(entity.ErrCodeUserNotExist, "User not exist")
+	}
+	usr, ok := u.(*entity.User)
+	if !ok {
+		return nil, errs.New(entity.ErrCodeUserNotExist, "User not exist")
+	}
+	return usr, nil
+}
+
+// loadCredential stored credential of a base64url encoded credential id
+func loadCredential(encodedID string) (*entity.WebAuthnCredential, error) {
+	id, err := decodeB64URL(encodedID)
+	if err != nil {
+		return nil, errs.Newf(entity.ErrCodeInvalidCredential, "Invalid credential: %v", err)
+	}
+	cred := &entity.WebAuthnCredential{
+		ID: base64.RawURLEncoding.EncodeToString(id),
+	}
+	v, ok := dao.Get(cred.Key())
+	if ok {
+		cred, ok = v.(*entity.WebAuthnCredential)
+	}
+	if !ok {
+		return nil, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: unknown credential")
+	}
+	return cred, nil
+}
+
+// newWebAuthnChallenge store a fresh challenge of a ceremony
+func newWebAuthnChallenge(typ, userName string) *entity.WebAuthnChallenge {
+	wc := &entity.WebAuthnChallenge{
+		Challenge:  randString(32),
+		Type:       typ,
+		UserName:   userName,
+		CreateTime: time.Now().Unix(),
+	}
+	dao.Set(wc.Key(), wc, time.Duration(entity.WebAuthnChallengeExpire)*time.Second)
+	return wc
+}
+
+// clientData collected client data, the JSON signed over by the authenticator
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// verifyClientData check the client data of a ceremony of typ and consume its challenge
+func (s *service) verifyClientData(encoded, typ string) (*entity.WebAuthnChallenge, []byte, error) {
+	raw, err := decodeB64URL(encoded)
+	if err != nil {
+		return nil, nil, errs.Newf(entity.ErrCodeInvalidCredential, "Invalid credential: %v", err)
+	}
+	cd := &clientData{}
+	if err = json.Unmarshal(raw, cd); err != nil {
+		return nil, nil, errs.Newf(entity.ErrCodeInvalidCredential, "Invalid credential: %v", err)
+	}
+	if cd.Type != typ {
+		return nil, nil, errs.Newf(entity.ErrCodeInvalidCredential, "Invalid credential: unexpected type %s", cd.Type)
+	}
+	if cd.Origin != s.rpOrigin {
+		return nil, nil, errs.Newf(entity.ErrCodeInvalidCredential, "Invalid credential: unexpected origin %s", cd.Origin)
+	}
+	wc := &entity.WebAuthnChallenge{
+		Challenge: cd.Challenge,
+	}
+	// single-use
+	s.webauthnLock.Lock()
+	v, ok := dao.Get(wc.Key())
+	dao.Delete(wc.Key())
+	s.webauthnLock.Unlock()
+	if ok {
+		wc, ok = v.(*entity.WebAuthnChallenge)
+	}
+	if !ok || cd.Challenge == "" || wc.Type != typ {
+		return nil, nil, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: unknown challenge")
+	}
+	return wc, raw, nil
+}
+
+// authData authenticator data, WebAuthn §6.1
+type authData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	// attested credential data, registration only
+	aaguid  []byte
+	credID  []byte
+	credKey []byte
+}
+
+// parseAuthData parse authenticator data and check it was made for this relying party with the user present
+func (s *service) parseAuthData(data []byte) (*authData, error) {
+	if len(data) < 37 {
+		return nil, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: short authenticator data")
+	}
+	ad := &authData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rpIDHash := sha256.Sum256([]byte(s.rpID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return nil, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: rp id mismatch")
+	}
+	if ad.flags&flagUP == 0 {
+		return nil, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: user not present")
+	}
+	rest := data[37:]
+	if ad.flags&flagAT != 0 {
+		if len(rest) < 18 {
+			return nil, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: short attested credential data")
+		}
+		ad.aaguid = rest[:16]
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < n || n > 1023 {
+			return nil, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: bad credential id")
+		}
+		ad.credID = rest[:n]
+		rest = rest[n:]
+		_, after, err := cborDecode(rest)
+		if err != nil {
+			return nil, errs.Newf(entity.ErrCodeInvalidCredential, "Invalid credential: %v", err)
+		}
+		ad.credKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+	if ad.flags&flagED != 0 {
+		var err error
+		if _, rest, err = cborDecode(rest); err != nil {
+			return nil, errs.Newf(entity.ErrCodeInvalidCredential, "Invalid credential: %v", err)
+		}
+	}
+	if len(rest) != 0 {
+		return nil, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: trailing authenticator data")
+	}
+	return ad, nil
+}
+
+// parseCOSEKey algorithm and public key of a COSE_Key, EC2 P-256 for ES256 or RSA for RS256
+func parseCOSEKey(data []byte) (int64, crypto.PublicKey, error) {
+	v, _, err := cborDecode(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return 0, nil, errors.New("malformed public key")
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	switch {
+	case alg == coseES256 && kty == 2:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return 0, nil, errors.New("invalid P-256 public key")
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return 0, nil, errors.New("invalid P-256 public key")
+		}
+		return alg, pub, nil
+	case alg == coseRS256 && kty == 3:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return 0, nil, errors.New("invalid RSA public key")
+		}
+		exp := 0
+		for _, b := range e {
+			exp = exp<<8 | int(b)
+		}
+		return alg, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, nil
+	}
+	return 0, nil, fmt.Errorf("unsupported key type %d alg %d", kty, alg)
+}
+
+// verifySignature verify sig over data with a public key of COSE algorithm alg
+func verifySignature(alg int64, pub crypto.PublicKey, data, sig []byte) error {
+	digest := sha256.Sum256(data)
+	switch alg {
+	case coseES256:
+		k, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("not ECDSA PublicKey type")
+		}
+		if !ecdsa.VerifyASN1(k, digest[:], sig) {
+			return errors.New("ecdsa verification error")
+		}
+		return nil
+	case coseRS256:
+		k, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("not RSA PublicKey type")
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+	}
+	return fmt.Errorf("unsupported alg %d", alg)
+}
+
+// verifyAttestation check the attestation statement of a new credential, WebAuthn §8.
+// Packed certificates are checked but not chained to a trusted root, there is no metadata service here.
+func verifyAttestation(format string, stmt map[interface{}]interface{}, authData, clientDataHash []byte,
+	credAlg int64, credPub crypto.PublicKey, aaguid []byte) error {
+	switch format {
+	case "none":
+		if len(stmt) != 0 {
+			return errors.New("none attestation with a statement")
+		}
+		return nil
+	case "packed":
+		alg, _ := stmt["alg"].(int64)
+		sig, _ := stmt["sig"].([]byte)
+		signed := append(append([]byte(nil), authData...), clientDataHash...)
+		x5c, ok := stmt["x5c"].([]interface{})
+		if !ok {
+			// self attestation, signed by the credential itself
+			if alg != credAlg {
+				return errors.New("self attestation alg mismatch")
+			}
+			return verifySignature(alg, credPub, signed, sig)
+		}
+		if len(x5c) == 0 {
+			return errors.New("empty x5c")
+		}
+		der, _ := x5c[0].([]byte)
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		if err = checkPackedCert(cert, aaguid); err != nil {
+			return err
+		}
+		return verifySignature(alg, cert.PublicKey, signed, sig)
+	}
+	return fmt.Errorf("unsupported attestation format %s", format)
+}
+
+// checkPackedCert requirements of a packed attestation certificate, WebAuthn §8.2.1
+func checkPackedCert(cert *x509.Certificate, aaguid []byte) error {
+	if cert.Version != 3 {
+		return errors.New("attestation certificate not v3")
+	}
+	if cert.BasicConstraintsValid && cert.IsCA {
+		return errors.New("attestation certificate is a CA")
+	}
+	ou := false
+	for _, unit := range cert.Subject.OrganizationalUnit {
+		ou = ou || unit == "Authenticator Attestation"
+	}
+	if !ou {
+		return errors.New("attestation certificate OU mismatch")
+	}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidAAGUID) {
+			continue
+		}
+		var value []byte
+		if _, err := asn1.Unmarshal(ext.Value, &value); err != nil || !bytes.Equal(value, aaguid) {
+			return errors.New("attestation certificate aaguid mismatch")
+		}
+	}
+	return nil
+}
+
+// credentialDescs registered credentials of the user
+func credentialDescs(userName string) []*entity.CredentialDesc {
+	user := &entity.User{
+		UserName: userName,
+	}
+	v, _ := dao.Get(user.CredentialsKey())
+	ids, _ := v.(map[string]bool)
+	descs := make([]*entity.CredentialDesc, 0, len(ids))
+	for id := range ids {
+		descs = append(descs, &entity.CredentialDesc{Type: "public-key", ID: id})
+	}
+	sort.Slice(descs, func(i, j int) bool {
+		return descs[i].ID < descs[j].ID
+	})
+	return descs
+}
+
+// userHandle opaque WebAuthn user id of a user
+func userHandle(userName string) []byte {
+	return hashData([]byte(userName))[:16]
+}
+
+// decodeB64URL decode base64url, with or without padding
+func decodeB64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
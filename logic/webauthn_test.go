@@ -0,0 +1,289 @@
+package logic
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/repo/dao"
+	"github.com/carterdings/authentication/repo/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+// softAuthenticator software WebAuthn authenticator holding a single credential
+type softAuthenticator struct {
+	id     []byte
+	alg    int64
+	ecKey  *ecdsa.PrivateKey
+	rsaKey *rsa.PrivateKey
+	aaguid []byte
+	count  uint32
+	rpID   string
+	origin string
+}
+
+func newSoftAuthenticator(t *testing.T, alg int64) *softAuthenticator {
+	a := &softAuthenticator{
+		id:     make([]byte, 32),
+		alg:    alg,
+		aaguid: make([]byte, 16),
+		rpID:   defaultRPID,
+		origin: defaultRPOrigin,
+	}
+	randBytes(a.id)
+	randBytes(a.aaguid)
+	var err error
+	if alg == coseES256 {
+		a.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else {
+		a.rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	assert.Nil(t, err)
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	if a.ecKey != nil {
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		a.ecKey.X.FillBytes(x)
+		a.ecKey.Y.FillBytes(y)
+		return cborEncode(map[interface{}]interface{}{1: 2, 3: coseES256, -1: 1, -2: x, -3: y})
+	}
+	e := big.NewInt(int64(a.rsaKey.E)).Bytes()
+	return cborEncode(map[interface{}]interface{}{1: 3, 3: coseRS256, -1: a.rsaKey.N.Bytes(), -2: e})
+}
+
+func (a *softAuthenticator) sign(data []byte) []byte {
+	digest := sha256.Sum256(data)
+	var sig []byte
+	if a.ecKey != nil {
+		sig, _ = ecdsa.SignASN1(rand.Reader, a.ecKey, digest[:])
+	} else {
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, a.rsaKey, crypto.SHA256, digest[:])
+	}
+	return sig
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	flags := byte(flagUP)
+	if attested {
+		flags |= flagAT
+	}
+	data = append(data, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.count)
+	if attested {
+		data = append(data, a.aaguid...)
+		data = append(data, byte(len(a.id)>>8), byte(len(a.id)))
+		data = append(data, a.id...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) clientData(typ, challenge string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":        typ,
+		"challenge":   challenge,
+		"origin":      a.origin,
+		"crossOrigin": false,
+	})
+	return data
+}
+
+// create navigator.credentials.create, format none, packed or packed-x5c
+func (a *softAuthenticator) create(t *testing.T, options *entity.PublicKeyOptions, format string) *entity.WebAuthnReq {
+	a.count++
+	clientData := a.clientData(webauthnCreate, options.Challenge)
+	authData := a.authData(true)
+	clientDataHash := sha256.Sum256(clientData)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	stmt := map[interface{}]interface{}{}
+	switch format {
+	case "packed":
+		stmt["alg"] = a.alg
+		stmt["sig"] = a.sign(signed)
+	case "packed-x5c":
+		format = "packed"
+		attKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.Nil(t, err)
+		aaguid, _ := asn1.Marshal(a.aaguid)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject: pkix.Name{
+				Organization:       []string{"Soft Authenticator"},
+				OrganizationalUnit: []string{"Authenticator Attestation"},
+				CommonName:         "soft",
+			},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			BasicConstraintsValid: true,
+			ExtraExtensions:       []pkix.Extension{{Id: oidAAGUID, Value: aaguid}},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &attKey.PublicKey, attKey)
+		assert.Nil(t, err)
+		digest := sha256.Sum256(signed)
+		sig, _ := ecdsa.SignASN1(rand.Reader, attKey, digest[:])
+		stmt["alg"] = int64(coseES256)
+		stmt["sig"] = sig
+		stmt["x5c"] = []interface{}{der}
+	}
+	att := cborEncode(map[interface{}]interface{}{"fmt": format, "authData": authData, "attStmt": stmt})
+	return &entity.WebAuthnReq{
+		ID:                base64.RawURLEncoding.EncodeToString(a.id),
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+		AttestationObject: base64.RawURLEncoding.EncodeToString(att),
+	}
+}
+
+// get navigator.credentials.get
+func (a *softAuthenticator) get(options *entity.PublicKeyOptions, userName string) *entity.WebAuthnReq {
+	a.count++
+	clientData := a.clientData(webauthnGet, options.Challenge)
+	authData := a.authData(false)
+	clientDataHash := sha256.Sum256(clientData)
+	return &entity.WebAuthnReq{
+		ID:                base64.RawURLEncoding.EncodeToString(a.id),
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+		AuthenticatorData: base64.RawURLEncoding.EncodeToString(authData),
+		Signature:         base64.RawURLEncoding.EncodeToString(a.sign(append(authData, clientDataHash[:]...))),
+		UserHandle:        base64.RawURLEncoding.EncodeToString(userHandle(userName)),
+	}
+}
+
+// Test_AuthService_WebAuthn ...
+func Test_AuthService_WebAuthn(t *testing.T) {
+	privKey, pubKey, err := GenRsaKey()
+	assert.Nil(t, err)
+	s := NewServie(privKey, pubKey)
+
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "passkey", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "passkey"})
+	rsp, err := s.Authenticate(&entity.UserRoleReq{UserName: "passkey", Password: "pwd"})
+	assert.Nil(t, err)
+	token := rsp.Token
+
+	ec := newSoftAuthenticator(t, coseES256)
+	rs := newSoftAuthenticator(t, coseRS256)
+	x5c := newSoftAuthenticator(t, coseES256)
+	tests := []struct {
+		name   string
+		a      *softAuthenticator
+		format string
+	}{
+		{"test_none_ES256", ec, "none"},
+		{"test_packed_self_RS256", rs, "packed"},
+		{"test_packed_x5c_ES256", x5c, "packed-x5c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			begin, err := s.BeginRegistration(&entity.WebAuthnReq{Token: token})
+			assert.Nil(t, err)
+			assert.Equal(t, defaultRPID, begin.Options.RP.ID)
+			req := tt.a.create(t, begin.Options, tt.format)
+			req.Token = token
+			finish, err := s.FinishRegistration(req)
+			assert.Nil(t, err)
+			assert.Equal(t, req.ID, finish.ID)
+		})
+	}
+
+	// a challenge is single-use and the credential registered once
+	begin, err := s.BeginRegistration(&entity.WebAuthnReq{Token: token})
+	assert.Nil(t, err)
+	assert.Len(t, begin.Options.ExcludeCredentials, 3)
+	req := ec.create(t, begin.Options, "none")
+	req.Token = token
+	_, err = s.FinishRegistration(req)
+	assert.Equal(t, errs.New(entity.ErrCodeCredentialExists, "Credential exists"), err)
+	_, err = s.FinishRegistration(req)
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: unknown challenge"), err)
+	// another origin
+	other := newSoftAuthenticator(t, coseES256)
+	other.origin = "https://evil.example"
+	begin, _ = s.BeginRegistration(&entity.WebAuthnReq{Token: token})
+	req = other.create(t, begin.Options, "none")
+	req.Token = token
+	_, err = s.FinishRegistration(req)
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: unexpected origin https://evil.example"), err)
+
+	// login
+	login, err := s.BeginLogin(&entity.WebAuthnReq{UserName: "passkey"})
+	assert.Nil(t, err)
+	assert.Len(t, login.Options.AllowCredentials, 3)
+	assertion := ec.get(login.Options, "passkey")
+	rsp, err = s.FinishLogin(assertion)
+	assert.Nil(t, err)
+	_, err = s.AllRoles(&entity.UserRoleReq{Token: rsp.Token})
+	assert.Nil(t, err)
+	_, err = s.FinishLogin(assertion)
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: unknown challenge"), err)
+
+	// discoverable credential, no user named
+	for _, a := range []*softAuthenticator{rs, x5c} {
+		login, err = s.BeginLogin(&entity.WebAuthnReq{})
+		assert.Nil(t, err)
+		assert.Empty(t, login.Options.AllowCredentials)
+		_, err = s.FinishLogin(a.get(login.Options, "passkey"))
+		assert.Nil(t, err)
+	}
+
+	// a cloned authenticator falls behind
+	login, _ = s.BeginLogin(&entity.WebAuthnReq{UserName: "passkey"})
+	ec.count--
+	_, err = s.FinishLogin(ec.get(login.Options, "passkey"))
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: sign counter regressed"), err)
+
+	// signed by another key
+	login, _ = s.BeginLogin(&entity.WebAuthnReq{UserName: "passkey"})
+	forged := ec.get(login.Options, "passkey")
+	forged.Signature = other.get(login.Options, "passkey").Signature
+	_, err = s.FinishLogin(forged)
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: bad signature"), err)
+
+	// challenge of another user
+	assert.Nil(t, s.CreateUser(&entity.UserReq{UserName: "passkey2", Password: "pwd"}))
+	defer s.DeleteUser(&entity.UserReq{UserName: "passkey2"})
+	login, _ = s.BeginLogin(&entity.WebAuthnReq{UserName: "passkey2"})
+	_, err = s.FinishLogin(ec.get(login.Options, "passkey"))
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: challenge of another user"), err)
+
+	// failed assertions count against the lockout, as wrong passwords do
+	for i := 0; i < 2; i++ {
+		login, _ = s.BeginLogin(&entity.WebAuthnReq{UserName: "passkey"})
+		forged = ec.get(login.Options, "passkey")
+		forged.Signature = other.get(login.Options, "passkey").Signature
+		forged.ClientIP = "10.0.0.8"
+		_, err = s.FinishLogin(forged)
+		assert.Equal(t, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: bad signature"), err)
+	}
+	login, _ = s.BeginLogin(&entity.WebAuthnReq{UserName: "passkey"})
+	_, err = s.FinishLogin(ec.get(login.Options, "passkey"))
+	assert.Equal(t, entity.ErrCodeAccountLocked, errs.ErrCode(err))
+	_, err = s.Authenticate(&entity.UserRoleReq{UserName: "passkey", Password: "pwd"})
+	assert.Equal(t, entity.ErrCodeAccountLocked, errs.ErrCode(err))
+	assert.Nil(t, s.Unlock(&entity.LockoutReq{UserName: "passkey", ClientIP: "10.0.0.8"}))
+
+	// credentials go with the user
+	assert.Nil(t, s.DeleteUser(&entity.UserReq{UserName: "passkey"}))
+	_, ok := dao.Get((&entity.WebAuthnCredential{ID: base64.RawURLEncoding.EncodeToString(ec.id)}).Key())
+	assert.False(t, ok)
+	login, _ = s.BeginLogin(&entity.WebAuthnReq{})
+	_, err = s.FinishLogin(ec.get(login.Options, "passkey"))
+	assert.Equal(t, errs.New(entity.ErrCodeInvalidCredential, "Invalid credential: unknown credential"), err)
+}
@@ -4,20 +4,83 @@ import (
 	"flag"
 	stdlog "log"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/carterdings/authentication/entity"
 	"github.com/carterdings/authentication/logic"
+	"github.com/carterdings/authentication/repo/dao"
 	"github.com/carterdings/authentication/repo/log"
+	"github.com/carterdings/authentication/repo/ratelimit"
 	"github.com/gin-gonic/gin"
 )
 
 var (
-	addr    string
-	logPath string
+	addr      string
+	logPath   string
+	storePath string
+	compact   time.Duration
+	restore   string
+	alg       string
+	keysDir   string
+	rotate    time.Duration
+	pwdHash   string
+	adminUser string
+	adminPwd  string
+	notify    string
+	rpID      string
+	rpOrigin  string
+	lockout   int
+	ipLockout int
+	lockDur   time.Duration
+	rateAuth  string
+	rateCheck string
+	rateAPI   string
+	pwdMin    int
+	pwdMax    int
+	pwdMix    int
+	pwdName   bool
+	breached  string
+	pwdHist   int
+	tokenFmt  string
+	clients   string
+	proxies   string
+	apiKeys   string
+	snapDir   string
 )
 
 func main() {
 	flag.StringVar(&addr, "addr", "127.0.0.1:8080", "server ip:port")
 	flag.StringVar(&logPath, "log", "gin.log", "log file path")
+	flag.StringVar(&storePath, "store", "", "durable store file path, in-memory only if empty")
+	flag.DurationVar(&compact, "compact", 10*time.Minute, "durable store compaction interval")
+	flag.StringVar(&restore, "restore", "", "snapshot file replacing the store at startup")
+	flag.StringVar(&snapDir, "snapshot_dir", "", "directory /admin/snapshot and /admin/restore use, they are disabled if empty")
+	flag.StringVar(&alg, "alg", logic.AlgRS256, "token signing algorithm: RS256, ES256, EdDSA or HS256")
+	flag.StringVar(&keysDir, "keys", "", "signing keys directory, keys are generated and kept in memory only if empty")
+	flag.DurationVar(&rotate, "rotate", 0, "signing key rotation interval, 0 disables rotation")
+	flag.StringVar(&pwdHash, "password_hash", logic.HashArgon2id, "password hashing algorithm: argon2id, bcrypt, scrypt or pbkdf2-sha256")
+	flag.StringVar(&adminUser, "admin_user", "", "admin created on first start when no user holds the admin role")
+	flag.StringVar(&adminPwd, "admin_password", "", "password of the bootstrap admin")
+	flag.StringVar(&notify, "notify_file", "", "file password reset codes are appended to, written to the log if empty")
+	flag.StringVar(&rpID, "rp_id", "localhost", "WebAuthn relying party id, the domain users log in on")
+	flag.StringVar(&rpOrigin, "rp_origin", "http://localhost:8080", "origin the WebAuthn ceremonies run in")
+	flag.IntVar(&lockout, "lockout_threshold", 5, "failed logins of a user before it is locked out")
+	flag.IntVar(&ipLockout, "ip_lockout_threshold", 20, "failed logins from a client IP before it is locked out")
+	flag.DurationVar(&lockDur, "lockout_duration", time.Minute, "first lockout, doubled on every further failed login")
+	flag.StringVar(&rateAuth, "rate_auth", "30/m", "rate limit of the login APIs per client IP, <n>/<s|m|h>, 0 disables")
+	flag.StringVar(&rateCheck, "rate_check", "100/s", "rate limit of check_role, all_roles, check_permission, jwks and introspect per API key or client IP")
+	flag.StringVar(&rateAPI, "rate_api", "20/s", "rate limit of the other APIs per token user or client IP")
+	flag.IntVar(&pwdMin, "password_min_length", 8, "characters a new password has at least")
+	flag.IntVar(&pwdMax, "password_max_length", 128, "characters a new password has at most")
+	flag.IntVar(&pwdMix, "password_classes", 0, "of lower case letters, upper case letters, digits and symbols a new password mixes at least")
+	flag.BoolVar(&pwdName, "password_reject_user_name", true, "reject new passwords containing the user name")
+	flag.StringVar(&breached, "breached_passwords", "", "file of breached or common passwords rejected, one per line")
+	flag.IntVar(&pwdHist, "password_history", 5, "last passwords a new one must differ from, the current one included, 0 disables")
+	flag.StringVar(&tokenFmt, "token_format", logic.TokenJWT, "access token format: jwt, or opaque tokens clients look up with /oauth/introspect")
+	flag.StringVar(&clients, "introspect_clients", "", "file of the clients allowed to introspect tokens, one <client_id>:<secret> per line")
+	flag.StringVar(&proxies, "trusted_proxies", "", "comma separated addresses or CIDRs of the proxies whose X-Forwarded-For is trusted, none if empty")
+	flag.StringVar(&apiKeys, "api_keys", "", "file of the X-API-Key values rate limited apart from their client IP, one per line")
 	if !flag.Parsed() {
 		flag.Parse()
 	}
@@ -26,11 +89,66 @@ func main() {
 }
 
 func initAndServe(addr, logPath string) {
-	privKey, pubKey, err := logic.GenRsaKey()
+	if alg == "" {
+		alg = logic.AlgRS256
+	}
+	keys, err := logic.NewKeyRing(alg, keysDir)
 	if err != nil {
 		stdlog.Fatal(err)
 	}
-	s := &Service{AuthService: logic.NewServie(privKey, pubKey)}
+	if rotate > 0 {
+		stop := keys.AutoRotate(rotate)
+		defer stop()
+	}
+	var notifier logic.Notifier
+	if notify != "" {
+		notifier = logic.NewFileNotifier(notify)
+	}
+	policy := &logic.PasswordPolicy{
+		MinLength:      pwdMin,
+		MaxLength:      pwdMax,
+		MinClasses:     pwdMix,
+		RejectUserName: pwdName,
+		History:        pwdHist,
+	}
+	if breached != "" {
+		policy.Breached, err = logic.LoadPasswordList(breached)
+		if err != nil {
+			stdlog.Fatal(err)
+		}
+	}
+	var introspectClients map[string]string
+	if clients != "" {
+		introspectClients, err = logic.LoadClients(clients)
+		if err != nil {
+			stdlog.Fatal(err)
+		}
+	}
+	as, err := logic.NewServiceWithConfig(&logic.Config{
+		KeyRing:      keys,
+		PasswordHash: pwdHash,
+		Notifier:     notifier,
+		RPID:         rpID,
+		RPOrigin:     rpOrigin,
+
+		LockoutThreshold:   lockout,
+		IPLockoutThreshold: ipLockout,
+		LockoutDuration:    lockDur,
+		PasswordPolicy:     policy,
+		TokenFormat:        tokenFmt,
+		Clients:            introspectClients,
+		SnapshotDir:        snapDir,
+	})
+	if err != nil {
+		stdlog.Fatal(err)
+	}
+	s := &Service{AuthService: as}
+	if apiKeys != "" {
+		s.APIKeys, err = loadAPIKeys(apiKeys)
+		if err != nil {
+			stdlog.Fatal(err)
+		}
+	}
 
 	gin.DisableConsoleColor()
 	f, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
@@ -39,17 +157,116 @@ func initAndServe(addr, logPath string) {
 	}
 	log.InitLogger(f)
 
+	if storePath != "" {
+		c, err := dao.NewFileClient(storePath, 5*time.Minute, 10*time.Minute, compact)
+		if err != nil {
+			stdlog.Fatal(err)
+		}
+		defer c.Close()
+		dao.DefaultClient = c
+	}
+	if restore != "" {
+		n, err := dao.RestoreFile(restore)
+		if err != nil {
+			stdlog.Fatal(err)
+		}
+		log.Infof("Restored %d entries from %s", n, restore)
+	}
+	if adminUser != "" {
+		err = as.Bootstrap(&entity.UserReq{UserName: adminUser, Password: adminPwd})
+		if err != nil {
+			stdlog.Fatal(err)
+		}
+	}
+
 	router := gin.Default()
+	// the client IP keys lockouts and rate limits, it is taken from headers set by known proxies only
+	err = router.SetTrustedProxies(proxyList(proxies))
+	if err != nil {
+		stdlog.Fatal(err)
+	}
+
+	// rate limits, strict on logins and generous on the checks other services make
+	limit := func(name, rate string, key func(c *gin.Context) string) gin.HandlerFunc {
+		r, err := ratelimit.ParseRate(rate)
+		if err != nil {
+			stdlog.Fatal(err)
+		}
+		return s.RateLimit(ratelimit.New(name, r), key)
+	}
+	login := router.Group("/", limit("auth", rateAuth, KeyByIP))
+	check := router.Group("/", limit("check", rateCheck, s.KeyByAPIKey))
+	api := router.Group("/", limit("api", rateAPI, s.KeyByUser))
+
+	check.POST("/user/check_role", s.CheckRole)
+	check.POST("/user/all_roles", s.AllRoles)
+	check.POST("/auth/check_permission", s.CheckPermission)
+	check.GET("/.well-known/jwks.json", s.JWKS)
+	check.POST("/oauth/introspect", s.Introspect)
+	login.POST("/auth/authenticate", s.Authenticate)
+	login.POST("/auth/refresh", s.Refresh)
+	login.POST("/auth/mfa", s.CompleteMFA)
+	login.POST("/auth/forgot_password", s.ForgotPassword)
+	login.POST("/auth/confirm_reset", s.ConfirmReset)
+	login.POST("/webauthn/login/begin", s.BeginLogin)
+	login.POST("/webauthn/login/finish", s.FinishLogin)
+	api.POST("/auth/invalidate", s.Invalidate)
+	api.POST("/mfa/totp/enroll", s.EnrollTOTP)
+	api.POST("/mfa/totp/confirm", s.ConfirmTOTP)
+	api.POST("/mfa/totp/disable", s.DisableTOTP)
+	api.POST("/mfa/recovery_codes", s.RecoveryCodes)
+	api.POST("/mfa/recovery_codes/regenerate", s.RegenerateRecoveryCodes)
+	api.POST("/webauthn/register/begin", s.BeginRegistration)
+	api.POST("/webauthn/register/finish", s.FinishRegistration)
+	api.POST("/user/change_password", s.ChangePassword)
+	api.POST("/user/sessions", s.ListSessions)
+	api.POST("/user/revoke_session", s.RevokeSession)
+	api.POST("/user/revoke_sessions", s.RevokeAllSessions)
 
-	router.POST("/user/create", s.CreateUser)
-	router.POST("/user/delete", s.DeleteUser)
-	router.POST("/user/add_role", s.AddRoleToUser)
-	router.POST("/user/check_role", s.CheckRole)
-	router.POST("/user/all_roles", s.AllRoles)
-	router.POST("/role/create", s.CreateRole)
-	router.POST("/role/delete", s.DeleteRole)
-	router.POST("/auth/authenticate", s.Authenticate)
-	router.POST("/auth/invalidate", s.Invalidate)
+	// management APIs, callers must present an admin token
+	admin := api.Group("/", s.RequireAdmin)
+	admin.POST("/user/create", s.CreateUser)
+	admin.POST("/user/delete", s.DeleteUser)
+	admin.POST("/user/add_role", s.AddRoleToUser)
+	admin.POST("/user/remove_role", s.RemoveRoleFromUser)
+	admin.POST("/user/reset_password", s.ResetPassword)
+	admin.POST("/role/create", s.CreateRole)
+	admin.POST("/role/delete", s.DeleteRole)
+	admin.POST("/role/add_child", s.AddRoleChild)
+	admin.POST("/role/remove_child", s.RemoveRoleChild)
+	admin.POST("/role/grant", s.GrantPermission)
+	admin.POST("/role/revoke", s.RevokePermission)
+	admin.POST("/admin/snapshot", s.Snapshot)
+	admin.POST("/admin/restore", s.Restore)
+	admin.POST("/admin/unlock", s.Unlock)
+
+	router.GET("/metrics", s.Metrics)
 
 	router.Run(addr)
 }
+
+// proxyList trusted proxies of the -trusted_proxies flag, nil trusts none
+func proxyList(s string) []string {
+	var list []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// loadAPIKeys keys of the -api_keys file, one per line, # starts a comment line
+func loadAPIKeys(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			keys[line] = true
+		}
+	}
+	return keys, nil
+}
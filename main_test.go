@@ -2,20 +2,88 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/carterdings/authentication/entity"
+	"github.com/carterdings/authentication/logic"
+	"github.com/carterdings/authentication/repo/ratelimit"
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
 
 // Test_Server ...
 func Test_Server(t *testing.T) {
-	go initAndServe("127.0.0.1:8080", "gin.log")
+	adminUser, adminPwd = "admin", "admin"
+	// the log stays out of the source tree
+	go initAndServe("127.0.0.1:8080", filepath.Join(t.TempDir(), "gin.log"))
 	time.Sleep(time.Second)
 
+	// management APIs reject callers without an admin token
+	rsp, result := post(t, "http://127.0.0.1:8080/user/create", `{"user_name":"cat","password":"test"}`, "")
+	assert.Equal(t, float64(entity.ErrCodeInvalidToken), result["code"])
+	assert.Equal(t, http.StatusUnauthorized, rsp.StatusCode)
+	assert.Contains(t, rsp.Header.Get("WWW-Authenticate"), `error="invalid_token"`)
+	rsp, result = post(t, "http://127.0.0.1:8080/auth/authenticate", `{"user_name":"admin","password":"admin"}`, "")
+	assert.Equal(t, float64(0), result["code"])
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	adminToken, _ := result["token"].(string)
+
+	t.Run("test_MalformedBody", func(t *testing.T) {
+		// answered once, in the envelope
+		rsp, result := post(t, "http://127.0.0.1:8080/auth/refresh", `{"refresh_token":`, "")
+		assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+		assert.Equal(t, float64(entity.ErrCodeInvalidParam), result["code"])
+	})
+
+	t.Run("test_BearerToken", func(t *testing.T) {
+		rsp, _ := post(t, "http://127.0.0.1:8080/user/create", `{"user_name":"dog","password":"test"}`, adminToken)
+		assert.Equal(t, http.StatusOK, rsp.StatusCode)
+		defer post(t, "http://127.0.0.1:8080/user/delete", `{"user_name":"dog"}`, adminToken)
+		rsp, _ = post(t, "http://127.0.0.1:8080/user/create", `{"user_name":"dog","password":"test"}`, adminToken)
+		assert.Equal(t, http.StatusConflict, rsp.StatusCode)
+		rsp, result := post(t, "http://127.0.0.1:8080/auth/authenticate", `{"user_name":"dog","password":"bad"}`, "")
+		assert.Equal(t, http.StatusUnauthorized, rsp.StatusCode)
+		assert.Equal(t, float64(entity.ErrCodeInvalidPassword), result["code"])
+		_, result = post(t, "http://127.0.0.1:8080/auth/authenticate", `{"user_name":"dog","password":"test"}`, "")
+		token, _ := result["token"].(string)
+
+		// the token in the header, the body may be left empty
+		rsp, result = post(t, "http://127.0.0.1:8080/user/all_roles", "", token)
+		assert.Equal(t, http.StatusOK, rsp.StatusCode)
+		assert.Equal(t, float64(0), result["code"])
+		// the token in a cookie, of JSON requests only
+		cookie := func(contentType string) int {
+			req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/user/all_roles", nil)
+			assert.Nil(t, err)
+			if contentType != "" {
+				req.Header.Set("Content-Type", contentType)
+			}
+			req.AddCookie(&http.Cookie{Name: "access_token", Value: token})
+			rsp, err := http.DefaultClient.Do(req)
+			assert.Nil(t, err)
+			rsp.Body.Close()
+			return rsp.StatusCode
+		}
+		assert.Equal(t, http.StatusOK, cookie("application/json; charset=utf-8"))
+		assert.Equal(t, http.StatusUnauthorized, cookie(""))
+		assert.Equal(t, http.StatusUnauthorized, cookie("text/plain"))
+		assert.Equal(t, http.StatusUnauthorized, cookie("application/x-www-form-urlencoded"))
+		// not an admin
+		rsp, result = post(t, "http://127.0.0.1:8080/role/create", `{"role_name":"dog"}`, token)
+		assert.Equal(t, http.StatusForbidden, rsp.StatusCode)
+		assert.Equal(t, float64(entity.ErrCodePermissionDenied), result["code"])
+		assert.Contains(t, rsp.Header.Get("WWW-Authenticate"), `error="insufficient_scope"`)
+	})
+
 	tests := []struct {
 		name string
 		furl string
@@ -23,28 +91,191 @@ func Test_Server(t *testing.T) {
 	}{
 		{"test_CreateUser", "http://127.0.0.1:8080/user/create", `{"user_name":"cat","password":"test"}`},
 		{"test_CreateRole", "http://127.0.0.1:8080/role/create", `{"role_name":"root"}`},
+		{"test_CreateChildRole", "http://127.0.0.1:8080/role/create", `{"role_name":"reader"}`},
+		{"test_AddRoleChild", "http://127.0.0.1:8080/role/add_child", `{"role_name":"root","child_role":"reader"}`},
 		{"test_AddRoleToUser", "http://127.0.0.1:8080/user/add_role", `{"user_name":"cat","password":"test","role_name":"root"}`},
 		{"test_Authenticate", "http://127.0.0.1:8080/auth/authenticate", `{"user_name":"cat","password":"test"}`},
+		{"test_ListSessions", "http://127.0.0.1:8080/user/sessions", `{"user_name":"cat"}`},
+		{"test_RevokeAllSessions", "http://127.0.0.1:8080/user/revoke_sessions", `{"user_name":"cat"}`},
+		{"test_ResetPassword", "http://127.0.0.1:8080/user/reset_password", `{"user_name":"cat","new_password":"test"}`},
+		{"test_ForgotPassword", "http://127.0.0.1:8080/auth/forgot_password", `{"user_name":"cat"}`},
+		{"test_ConfirmReset", "http://127.0.0.1:8080/auth/confirm_reset", `{"user_name":"cat","code":"guess","new_password":"test"}`},
 		{"test_Invalidate", "http://127.0.0.1:8080/auth/invalidate", `{"user_name":"cat","password":"test","token":"expire=7200&rand=ZrCV4SLd0euk4lcHHH2cHA&token=FKunVi5yiLpGOnt5CplnT7rWtzdp-eJ4w_l9T9Yx_eUHkqBOP-ZxDHKi6nqn33JjCeSetuGlEsQ8thBU9Y5ZXG__lvBcwFhRWbWLHR_fiXQgyobrtM4bxvzXTZpGNX5Jf9ssL2YoHqeihGuHWq4DyJnqZkiVz51P5Kqh3-2WVqA&ts=1661841402&user=cat"}`},
 		{"test_CheckRole", "http://127.0.0.1:8080/user/check_role", `{"user_name":"cat","password":"test","role_name":"root","token":"expire=7200&rand=ZrCV4SLd0euk4lcHHH2cHA&token=FKunVi5yiLpGOnt5CplnT7rWtzdp-eJ4w_l9T9Yx_eUHkqBOP-ZxDHKi6nqn33JjCeSetuGlEsQ8thBU9Y5ZXG__lvBcwFhRWbWLHR_fiXQgyobrtM4bxvzXTZpGNX5Jf9ssL2YoHqeihGuHWq4DyJnqZkiVz51P5Kqh3-2WVqA&ts=1661841402&user=cat"}`},
 		{"test_AllRoles", "http://127.0.0.1:8080/user/all_roles", `{"user_name":"cat","password":"test","role_name":"root","token":"expire=7200&rand=ZrCV4SLd0euk4lcHHH2cHA&token=FKunVi5yiLpGOnt5CplnT7rWtzdp-eJ4w_l9T9Yx_eUHkqBOP-ZxDHKi6nqn33JjCeSetuGlEsQ8thBU9Y5ZXG__lvBcwFhRWbWLHR_fiXQgyobrtM4bxvzXTZpGNX5Jf9ssL2YoHqeihGuHWq4DyJnqZkiVz51P5Kqh3-2WVqA&ts=1661841402&user=cat"}`},
 
+		{"test_GrantPermission", "http://127.0.0.1:8080/role/grant", `{"role_name":"reader","permission":"doc:*"}`},
+		{"test_CheckPermission", "http://127.0.0.1:8080/auth/check_permission", `{"permission":"doc:read"}`},
+		{"test_RevokePermission", "http://127.0.0.1:8080/role/revoke", `{"role_name":"reader","permission":"doc:*"}`},
+		{"test_AddScopedRole", "http://127.0.0.1:8080/user/add_role", `{"user_name":"cat","role_name":"reader","resource":"project/42"}`},
+		{"test_AddTimeBoundRole", "http://127.0.0.1:8080/user/add_role", fmt.Sprintf(`{"user_name":"cat","role_name":"reader","expire_at":%d}`, time.Now().Unix()+3600)},
+		{"test_RemoveTimeBoundRole", "http://127.0.0.1:8080/user/remove_role", `{"user_name":"cat","role_name":"reader"}`},
+		{"test_RemoveScopedRole", "http://127.0.0.1:8080/user/remove_role", `{"user_name":"cat","role_name":"reader","resource":"project/42"}`},
+		{"test_RemoveRoleChild", "http://127.0.0.1:8080/role/remove_child", `{"role_name":"root","child_role":"reader"}`},
+		{"test_DeleteChildRole", "http://127.0.0.1:8080/role/delete", `{"role_name":"reader"}`},
+
+		{"test_RemoveRoleFromUser", "http://127.0.0.1:8080/user/remove_role", `{"user_name":"cat","role_name":"root"}`},
+
 		{"test_DeleteUser", "http://127.0.0.1:8080/user/delete", `{"user_name":"cat"}`},
 		{"test_DeleteRole", "http://127.0.0.1:8080/role/delete", `{"role_name":"root"}`},
+		// revokes the admin token, keep last
+		{"test_EnrollTOTP", "http://127.0.0.1:8080/mfa/totp/enroll", `{}`},
+		{"test_ConfirmTOTP", "http://127.0.0.1:8080/mfa/totp/confirm", `{"code":"000000"}`},
+		{"test_CompleteMFA", "http://127.0.0.1:8080/auth/mfa", `{"mfa_token":"guess","code":"000000"}`},
+		{"test_RecoveryCodes", "http://127.0.0.1:8080/mfa/recovery_codes", `{}`},
+		{"test_RegenerateRecoveryCodes", "http://127.0.0.1:8080/mfa/recovery_codes/regenerate", `{"code":"aaaaa-aaaaa"}`},
+		{"test_BeginRegistration", "http://127.0.0.1:8080/webauthn/register/begin", `{}`},
+		{"test_FinishRegistration", "http://127.0.0.1:8080/webauthn/register/finish", `{"id":"AA","client_data_json":"e30","attestation_object":"oA"}`},
+		{"test_BeginLogin", "http://127.0.0.1:8080/webauthn/login/begin", `{"user_name":"admin"}`},
+		{"test_FinishLogin", "http://127.0.0.1:8080/webauthn/login/finish", `{"id":"AA","client_data_json":"e30","authenticator_data":"AA","signature":"AA"}`},
+		{"test_Unlock", "http://127.0.0.1:8080/admin/unlock", `{"user_name":"cat","client_ip":"127.0.0.1"}`},
+		{"test_ChangePassword", "http://127.0.0.1:8080/user/change_password", `{"password":"admin","new_password":"admin"}`},
 	}
 
+	t.Run("test_JWKS", func(t *testing.T) {
+		rsp, err := http.Get("http://127.0.0.1:8080/.well-known/jwks.json")
+		assert.Nil(t, err)
+		defer rsp.Body.Close()
+		var result map[string][]map[string]string
+		err = json.NewDecoder(rsp.Body).Decode(&result)
+		assert.Nil(t, err)
+		assert.Len(t, result["keys"], 1)
+		assert.Equal(t, "RSA", result["keys"][0]["kty"])
+	})
+
+	t.Run("test_Metrics", func(t *testing.T) {
+		rsp, err := http.Get("http://127.0.0.1:8080/metrics")
+		assert.Nil(t, err)
+		defer rsp.Body.Close()
+		data, err := ioutil.ReadAll(rsp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, rsp.StatusCode)
+		assert.Contains(t, string(data), `ratelimit_allowed_total{limiter="auth"}`)
+		assert.Contains(t, string(data), `ratelimit_rejected_total{limiter="api"} 0`)
+	})
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			rsp, err := http.Post(tt.furl, "application/json", strings.NewReader(tt.body))
-			assert.Nil(t, err)
-			defer rsp.Body.Close()
-			data, err := ioutil.ReadAll(rsp.Body)
-			assert.Nil(t, err)
-			t.Logf("furl: %s, rsp data: %s", tt.furl, string(data))
-			var result map[string]interface{}
-			err = json.Unmarshal(data, &result)
-			assert.Nil(t, err)
+			_, result := post(t, tt.furl, tt.body, adminToken)
 			t.Logf("response: %+v", result)
 		})
 	}
 }
+
+// Test_TrustedProxies ...
+func Test_TrustedProxies(t *testing.T) {
+	assert.Nil(t, proxyList(""))
+	assert.Equal(t, []string{"10.0.0.1", "192.168.0.0/16"}, proxyList(" 10.0.0.1, ,192.168.0.0/16"))
+
+	clientIP := func(proxies string) string {
+		router := gin.New()
+		assert.Nil(t, router.SetTrustedProxies(proxyList(proxies)))
+		router.GET("/ip", func(c *gin.Context) { c.String(http.StatusOK, c.ClientIP()) })
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/ip", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		router.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+	// a forged header is ignored unless it comes from a trusted proxy
+	assert.Equal(t, "192.0.2.1", clientIP(""))
+	assert.Equal(t, "203.0.113.7", clientIP("192.0.2.0/24"))
+}
+
+// Test_RateLimit ...
+func Test_RateLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api_keys.txt")
+	assert.Nil(t, os.WriteFile(path, []byte("# checks\nreporting\n\n"), 0600))
+	keys, err := loadAPIKeys(path)
+	assert.Nil(t, err)
+	s := &Service{APIKeys: keys}
+	router := gin.New()
+	assert.Nil(t, router.SetTrustedProxies(proxyList("")))
+	router.POST("/limited", s.RateLimit(ratelimit.New("test", ratelimit.Rate{Limit: 1.0 / 30, Burst: 2}), s.KeyByAPIKey),
+		func(c *gin.Context) { c.PureJSON(http.StatusOK, gin.H{"code": 0, "msg": ""}) })
+
+	do := func(apiKey string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/limited", nil)
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		// forged, no proxy is trusted
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("203.0.113.%d", rand.Intn(256)))
+		router.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, http.StatusOK, do("").Code)
+	assert.Equal(t, http.StatusOK, do("").Code)
+	w := do("")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), fmt.Sprintf(`"code":%d`, entity.ErrCodeRateLimited))
+	// another caller behind the same address
+	assert.Equal(t, http.StatusOK, do("reporting").Code)
+	// made-up keys get no bucket of their own
+	assert.Equal(t, http.StatusTooManyRequests, do("made-up").Code)
+
+	w = httptest.NewRecorder()
+	router.GET("/metrics", s.Metrics)
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, w.Body.String(), `ratelimit_rejected_total{limiter="test"} 2`)
+	assert.Contains(t, w.Body.String(), `ratelimit_keys{limiter="test"} 2`)
+}
+
+// Test_Introspect ...
+func Test_Introspect(t *testing.T) {
+	privKey, pubKey, err := logic.GenRsaKey()
+	assert.Nil(t, err)
+	as, err := logic.NewServiceWithConfig(&logic.Config{PrivKey: privKey, PubKey: pubKey,
+		TokenFormat: logic.TokenOpaque, Clients: map[string]string{"billing": "s3cret"}})
+	assert.Nil(t, err)
+	assert.Nil(t, as.CreateUser(&entity.UserReq{UserName: "introspected", Password: "pwd"}))
+	defer as.DeleteUser(&entity.UserReq{UserName: "introspected"})
+	rsp, err := as.Authenticate(&entity.UserRoleReq{UserName: "introspected", Password: "pwd"})
+	assert.Nil(t, err)
+
+	s := &Service{AuthService: as}
+	router := gin.New()
+	router.POST("/oauth/introspect", s.Introspect)
+	do := func(secret, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/oauth/introspect", strings.NewReader("token="+token))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("billing", secret)
+		router.ServeHTTP(w, req)
+		return w
+	}
+	w := do("guess", rsp.Token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Basic realm="authentication"`, w.Header().Get("WWW-Authenticate"))
+	w = do("s3cret", rsp.Token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Contains(t, w.Body.String(), `"active":true`)
+	assert.Contains(t, w.Body.String(), `"sub":"introspected"`)
+	w = do("s3cret", "garbage")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"code":0,"msg":"","active":false}`, w.Body.String())
+}
+
+// post post body with the bearer token and decode the response
+func post(t *testing.T, furl, body, token string) (*http.Response, map[string]interface{}) {
+	req, err := http.NewRequest(http.MethodPost, furl, strings.NewReader(body))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer rsp.Body.Close()
+	data, err := ioutil.ReadAll(rsp.Body)
+	assert.Nil(t, err)
+	t.Logf("furl: %s, rsp data: %s", furl, string(data))
+	var result map[string]interface{}
+	err = json.Unmarshal(data, &result)
+	assert.Nil(t, err)
+	return rsp, result
+}
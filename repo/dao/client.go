@@ -11,6 +11,7 @@ type Client interface {
 	Get(key string) (interface{}, bool)
 	Set(key string, val interface{}, d time.Duration)
 	Delete(key string)
+	Items() map[string]cache.Item
 }
 
 // New new client
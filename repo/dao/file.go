@@ -0,0 +1,302 @@
+package dao
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/carterdings/authentication/repo/log"
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	opSet    = 1
+	opDelete = 2
+
+	// recordHeaderLen 4 bytes payload length + 4 bytes crc32 of payload
+	recordHeaderLen = 8
+	// maxRecordLen guards against reading garbage lengths from a torn write
+	maxRecordLen = 64 << 20
+)
+
+// errTornRecord a record cut short by the end of the file
+var errTornRecord = errors.New("torn record")
+
+// record one entry of the append-only log
+type record struct {
+	Op     int
+	Key    string
+	Val    interface{}
+	Expire int64 // unix nano, 0 means no expiration
+}
+
+// Register registers the concrete types stored through the client,
+// so that they can be written to and read back from the log file.
+func Register(vals ...interface{}) {
+	for _, v := range vals {
+		gob.Register(v)
+	}
+}
+
+// FileClient durable client, every mutation is appended to a log file
+// before being applied to the in-memory cache, and the log is compacted
+// periodically so that it only holds live entries.
+type FileClient struct {
+	path              string
+	defaultExpiration time.Duration
+
+	mu    sync.Mutex
+	f     *os.File
+	cache *cache.Cache
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewFileClient open or create the log file at path, replay it and start the compaction loop.
+// compactInterval <= 0 disables periodic compaction.
+func NewFileClient(path string, defaultExpiration, cleanupInterval, compactInterval time.Duration) (*FileClient, error) {
+	c := &FileClient{
+		path:              path,
+		defaultExpiration: defaultExpiration,
+		cache:             cache.New(defaultExpiration, cleanupInterval),
+		stop:              make(chan struct{}),
+	}
+	if err := c.replay(); err != nil {
+		return nil, err
+	}
+	// start from a compacted log, this also drops a torn final record
+	if err := c.Compact(); err != nil {
+		return nil, err
+	}
+	if compactInterval > 0 {
+		c.wg.Add(1)
+		go c.compactLoop(compactInterval)
+	}
+	return c, nil
+}
+
+// Get get
+func (c *FileClient) Get(key string) (interface{}, bool) {
+	return c.cache.Get(key)
+}
+
+// Set set, the cache is left as is if the change cannot be written to the log
+func (c *FileClient) Set(key string, val interface{}, d time.Duration) {
+	if d == cache.DefaultExpiration {
+		d = c.defaultExpiration
+	}
+	var expire int64
+	if d > 0 {
+		expire = time.Now().Add(d).UnixNano()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.append(&record{Op: opSet, Key: key, Val: val, Expire: expire}); err != nil {
+		log.Errorf("dao append set %s: %v", key, err)
+		return
+	}
+	c.cache.Set(key, val, d)
+}
+
+// Delete delete, the cache is left as is if the change cannot be written to the log
+func (c *FileClient) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.append(&record{Op: opDelete, Key: key}); err != nil {
+		log.Errorf("dao append delete %s: %v", key, err)
+		return
+	}
+	c.cache.Delete(key)
+}
+
+// Items copy of all unexpired items
+func (c *FileClient) Items() map[string]cache.Item {
+	return c.cache.Items()
+}
+
+// Compact rewrite the log file with the live entries only
+func (c *FileClient) Compact() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tmp := c.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for k, item := range c.cache.Items() {
+		err = writeRecord(w, &record{Op: opSet, Key: k, Val: item.Object, Expire: item.Expiration})
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = os.Rename(tmp, c.path); err != nil {
+		f.Close()
+		return err
+	}
+	// make the rename itself durable
+	if err = syncDir(filepath.Dir(c.path)); err != nil {
+		f.Close()
+		return err
+	}
+	if c.f != nil {
+		c.f.Close()
+	}
+	c.f = f
+	return nil
+}
+
+// Close stop compaction and close the log file
+func (c *FileClient) Close() error {
+	close(c.stop)
+	c.wg.Wait()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
+
+func (c *FileClient) compactLoop(interval time.Duration) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if err := c.Compact(); err != nil {
+				log.Errorf("dao compact %s: %v", c.path, err)
+			}
+		}
+	}
+}
+
+// append write one record and flush it to disk, c.mu must be held
+func (c *FileClient) append(r *record) error {
+	if c.f == nil {
+		return errors.New("log file closed")
+	}
+	if err := writeRecord(c.f, r); err != nil {
+		return err
+	}
+	return c.f.Sync()
+}
+
+// replay load the log file into the cache. A broken final record is the trace of a crash
+// in the middle of a write and is dropped, a broken record followed by others is corruption
+// and fails the replay, compacting would lose every record after it.
+func (c *FileClient) replay() error {
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	now := time.Now().UnixNano()
+	for n := 1; ; n++ {
+		rec, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if _, perr := r.Peek(1); err == errTornRecord || perr == io.EOF {
+				log.Errorf("dao replay %s dropped a broken final record: %v", c.path, err)
+				return nil
+			}
+			return fmt.Errorf("dao replay %s: record %d corrupted: %v", c.path, n, err)
+		}
+		switch rec.Op {
+		case opSet:
+			if rec.Expire == 0 {
+				c.cache.Set(rec.Key, rec.Val, cache.NoExpiration)
+			} else if rec.Expire > now {
+				c.cache.Set(rec.Key, rec.Val, time.Duration(rec.Expire-now))
+			} else {
+				c.cache.Delete(rec.Key)
+			}
+		case opDelete:
+			c.cache.Delete(rec.Key)
+		}
+	}
+}
+
+func writeRecord(w io.Writer, r *record) error {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(r); err != nil {
+		return err
+	}
+	payload := buf.Bytes()
+	header := make([]byte, recordHeaderLen)
+	binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+func readRecord(r io.Reader) (*record, error) {
+	header := make([]byte, recordHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errTornRecord
+		}
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:4])
+	if n > maxRecordLen {
+		return nil, errors.New("invalid record length")
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errTornRecord
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errors.New("record checksum mismatch")
+	}
+	rec := &record{}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// syncDir flush the entries of the directory at path to disk
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
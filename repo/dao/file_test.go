@@ -0,0 +1,150 @@
+package dao
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+)
+
+type testVal struct {
+	Name string
+}
+
+// Test_FileClient ...
+func Test_FileClient(t *testing.T) {
+	Register(&testVal{}, map[string]bool{})
+	path := filepath.Join(t.TempDir(), "auth.db")
+
+	c, err := NewFileClient(path, 5*time.Minute, 10*time.Minute, 0)
+	assert.Nil(t, err)
+	c.Set("foo", &testVal{Name: "bar"}, cache.NoExpiration)
+	c.Set("roles", map[string]bool{"root": true}, cache.NoExpiration)
+	c.Set("bind", nil, cache.NoExpiration)
+	c.Set("short", "gone", time.Millisecond)
+	c.Set("tmp", "tmp", cache.NoExpiration)
+	c.Delete("tmp")
+	assert.Nil(t, c.Close())
+
+	time.Sleep(5 * time.Millisecond)
+
+	// replay
+	c, err = NewFileClient(path, 5*time.Minute, 10*time.Minute, 0)
+	assert.Nil(t, err)
+	v, ok := c.Get("foo")
+	assert.True(t, ok)
+	assert.Equal(t, &testVal{Name: "bar"}, v)
+	v, ok = c.Get("roles")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]bool{"root": true}, v)
+	_, ok = c.Get("bind")
+	assert.True(t, ok)
+	_, ok = c.Get("short")
+	assert.False(t, ok)
+	_, ok = c.Get("tmp")
+	assert.False(t, ok)
+	assert.Nil(t, c.Close())
+}
+
+// Test_FileClient_TornWrite ...
+func Test_FileClient_TornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.db")
+
+	c, err := NewFileClient(path, 5*time.Minute, 10*time.Minute, 0)
+	assert.Nil(t, err)
+	c.Set("foo", "bar", cache.NoExpiration)
+	c.Set("baz", "qux", cache.NoExpiration)
+	assert.Nil(t, c.Close())
+
+	// simulate a crash in the middle of the last write
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(path, info.Size()-3))
+
+	c, err = NewFileClient(path, 5*time.Minute, 10*time.Minute, 0)
+	assert.Nil(t, err)
+	_, ok := c.Get("foo")
+	assert.True(t, ok)
+	_, ok = c.Get("baz")
+	assert.False(t, ok)
+
+	// the broken tail is dropped, new writes survive
+	c.Set("baz", "qux", cache.NoExpiration)
+	assert.Nil(t, c.Close())
+	c, err = NewFileClient(path, 5*time.Minute, 10*time.Minute, 0)
+	assert.Nil(t, err)
+	v, ok := c.Get("baz")
+	assert.True(t, ok)
+	assert.Equal(t, "qux", v)
+	assert.Nil(t, c.Close())
+}
+
+// Test_FileClient_Corrupted ...
+func Test_FileClient_Corrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.db")
+
+	c, err := NewFileClient(path, 5*time.Minute, 10*time.Minute, 0)
+	assert.Nil(t, err)
+	c.Set("foo", "bar", cache.NoExpiration)
+	c.Set("baz", "qux", cache.NoExpiration)
+	assert.Nil(t, c.Close())
+
+	// flip a byte of the first record, the second one follows it
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	data[recordHeaderLen+1] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, data, 0600))
+
+	_, err = NewFileClient(path, 5*time.Minute, 10*time.Minute, 0)
+	assert.Equal(t, "dao replay "+path+": record 1 corrupted: record checksum mismatch", err.Error())
+	// the file is left for repair, not compacted
+	after, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, data, after)
+}
+
+// Test_FileClient_AppendFailure ...
+func Test_FileClient_AppendFailure(t *testing.T) {
+	c, err := NewFileClient(filepath.Join(t.TempDir(), "auth.db"), 5*time.Minute, 10*time.Minute, 0)
+	assert.Nil(t, err)
+	c.Set("foo", "bar", cache.NoExpiration)
+	assert.Nil(t, c.Close())
+
+	// changes that cannot be logged are not applied
+	c.Set("baz", "qux", cache.NoExpiration)
+	_, ok := c.Get("baz")
+	assert.False(t, ok)
+	c.Delete("foo")
+	_, ok = c.Get("foo")
+	assert.True(t, ok)
+}
+
+// Test_FileClient_Compact ...
+func Test_FileClient_Compact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.db")
+
+	c, err := NewFileClient(path, 5*time.Minute, 10*time.Minute, 0)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		c.Set("foo", i, cache.NoExpiration)
+	}
+	before, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Compact())
+	after, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Less(t, after.Size(), before.Size())
+
+	c.Set("bar", 1, cache.NoExpiration)
+	assert.Nil(t, c.Close())
+	c, err = NewFileClient(path, 5*time.Minute, 10*time.Minute, 0)
+	assert.Nil(t, err)
+	v, _ := c.Get("foo")
+	assert.Equal(t, 99, v)
+	v, _ = c.Get("bar")
+	assert.Equal(t, 1, v)
+	assert.Nil(t, c.Close())
+}
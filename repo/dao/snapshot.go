@@ -0,0 +1,122 @@
+package dao
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	// SnapshotVersion current snapshot format version
+	SnapshotVersion = 1
+
+	snapshotMagic = "AUTHSNAP"
+)
+
+// snapshot whole store dump
+type snapshot struct {
+	Version    int
+	CreateTime int64
+	Entries    []snapshotEntry
+}
+
+// snapshotEntry one key, Expire is unix nano and 0 means no expiration
+type snapshotEntry struct {
+	Key    string
+	Val    interface{}
+	Expire int64
+}
+
+// Dump write all unexpired entries of the default client to w
+func Dump(w io.Writer) (int, error) {
+	snap := &snapshot{
+		Version:    SnapshotVersion,
+		CreateTime: time.Now().Unix(),
+	}
+	for k, item := range DefaultClient.Items() {
+		snap.Entries = append(snap.Entries, snapshotEntry{Key: k, Val: item.Object, Expire: item.Expiration})
+	}
+	if _, err := io.WriteString(w, snapshotMagic); err != nil {
+		return 0, err
+	}
+	if err := gob.NewEncoder(w).Encode(snap); err != nil {
+		return 0, err
+	}
+	return len(snap.Entries), nil
+}
+
+// Restore replace the entries of the default client with those read from r,
+// entries already expired are skipped and the others keep their remaining TTL.
+// Nothing is removed if r is not a valid snapshot.
+func Restore(r io.Reader) (int, error) {
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != snapshotMagic {
+		return 0, errors.New("not a snapshot file")
+	}
+	snap := &snapshot{}
+	if err := gob.NewDecoder(r).Decode(snap); err != nil {
+		return 0, err
+	}
+	if snap.Version > SnapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+	// entries written after the snapshot go, whatever they grant
+	for k := range DefaultClient.Items() {
+		DefaultClient.Delete(k)
+	}
+	n := 0
+	now := time.Now().UnixNano()
+	for _, e := range snap.Entries {
+		switch {
+		case e.Expire == 0:
+			DefaultClient.Set(e.Key, e.Val, cache.NoExpiration)
+		case e.Expire > now:
+			DefaultClient.Set(e.Key, e.Val, time.Duration(e.Expire-now))
+		default:
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+// DumpFile dump the default client to path, the file is replaced atomically
+func DumpFile(path string) (int, error) {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(f)
+	n, err := Dump(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return n, os.Rename(tmp, path)
+}
+
+// RestoreFile replace the default client with the snapshot at path
+func RestoreFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return Restore(bufio.NewReader(f))
+}
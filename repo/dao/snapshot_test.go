@@ -0,0 +1,58 @@
+package dao
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_Snapshot ...
+func Test_Snapshot(t *testing.T) {
+	Register(&testVal{}, map[string]bool{})
+	path := filepath.Join(t.TempDir(), "auth.snap")
+
+	old := DefaultClient
+	defer func() { DefaultClient = old }()
+
+	DefaultClient = New(5*time.Minute, 10*time.Minute)
+	Set("user_cat", &testVal{Name: "cat"}, cache.NoExpiration)
+	Set("user_roles_cat", map[string]bool{"root": true}, cache.NoExpiration)
+	Set("bind_cat_root", nil, cache.NoExpiration)
+	Set("token", nil, time.Hour)
+	n, err := DumpFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+
+	// fresh process
+	DefaultClient = New(5*time.Minute, 10*time.Minute)
+	Set("user_dog", &testVal{Name: "dog"}, cache.NoExpiration)
+	n, err = RestoreFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+
+	v, ok := Get("user_cat")
+	assert.True(t, ok)
+	assert.Equal(t, &testVal{Name: "cat"}, v)
+	v, ok = Get("user_roles_cat")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]bool{"root": true}, v)
+	_, ok = Get("bind_cat_root")
+	assert.True(t, ok)
+	_, exp, ok := DefaultClient.(*cache.Cache).GetWithExpiration("token")
+	assert.True(t, ok)
+	assert.True(t, time.Until(exp) > 59*time.Minute)
+	// the store is replaced, not merged
+	_, ok = Get("user_dog")
+	assert.False(t, ok)
+	assert.Len(t, DefaultClient.Items(), 4)
+
+	_, err = RestoreFile(filepath.Join(t.TempDir(), "missing"))
+	assert.NotNil(t, err)
+	_, err = Restore(strings.NewReader("garbage"))
+	assert.NotNil(t, err)
+	assert.Len(t, DefaultClient.Items(), 4)
+}
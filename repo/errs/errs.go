@@ -1,6 +1,9 @@
 package errs
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 const (
 	ErrTypeFramework = 1
@@ -26,26 +29,37 @@ type Err struct {
 	Type int
 	Code int
 	Msg  string
+	// Details what exactly went wrong, for the caller to fix
+	Details []string
 }
 
 // Error error
 func (e *Err) Error() string {
+	if len(e.Details) > 0 {
+		return fmt.Sprintf("type: %s, code: %d, msg: %s, details: %s",
+			ErrTypeMap[e.Type], e.Code, e.Msg, strings.Join(e.Details, "; "))
+	}
 	return fmt.Sprintf("type: %s, code: %d, msg: %s", ErrTypeMap[e.Type], e.Code, e.Msg)
 }
 
 // NewFrameworkErr new framework error
 func NewFrameworkErr(code int, msg string) error {
-	return &Err{ErrTypeFramework, code, msg}
+	return &Err{Type: ErrTypeFramework, Code: code, Msg: msg}
 }
 
 // New new error
 func New(code int, msg string) error {
-	return &Err{ErrTypeBusiness, code, msg}
+	return &Err{Type: ErrTypeBusiness, Code: code, Msg: msg}
 }
 
 // Newf new formatted error
 func Newf(code int, format string, args ...interface{}) error {
-	return &Err{ErrTypeBusiness, code, fmt.Sprintf(format, args...)}
+	return &Err{Type: ErrTypeBusiness, Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// NewWithDetails new error listing what went wrong
+func NewWithDetails(code int, msg string, details []string) error {
+	return &Err{Type: ErrTypeBusiness, Code: code, Msg: msg, Details: details}
 }
 
 // ErrCode get error code
@@ -77,3 +91,12 @@ func ErrMsg(err error) string {
 	}
 	return e.Msg
 }
+
+// ErrDetails get error details, nil if there are none
+func ErrDetails(err error) []string {
+	e, ok := err.(*Err)
+	if !ok || e == nil {
+		return nil
+	}
+	return e.Details
+}
@@ -43,4 +43,12 @@ func Test_Err(t *testing.T) {
 	assert.Equal(t, ErrCodeUnknown, code)
 	msg = ErrMsg(err)
 	assert.Equal(t, "test", msg)
+	assert.Nil(t, ErrDetails(err))
+
+	e = NewWithDetails(4, "bad input", []string{"too short", "too plain"})
+	assert.Equal(t, 4, ErrCode(e))
+	assert.Equal(t, "bad input", ErrMsg(e))
+	assert.Equal(t, []string{"too short", "too plain"}, ErrDetails(e))
+	assert.Equal(t, "type: business, code: 4, msg: bad input, details: too short; too plain", e.Error())
+	assert.Nil(t, ErrDetails(New(5, "no details")))
 }
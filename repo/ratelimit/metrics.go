@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// metric one family of the exposition
+type metric struct {
+	name  string
+	typ   string
+	help  string
+	value func(s Stats) string
+}
+
+var metrics = []metric{
+	{"ratelimit_allowed_total", "counter", "Requests let through by the rate limiter.",
+		func(s Stats) string { return strconv.FormatUint(s.Allowed, 10) }},
+	{"ratelimit_rejected_total", "counter", "Requests rejected by the rate limiter.",
+		func(s Stats) string { return strconv.FormatUint(s.Rejected, 10) }},
+	{"ratelimit_keys", "gauge", "Keys holding a bucket.",
+		func(s Stats) string { return strconv.Itoa(s.Keys) }},
+	{"ratelimit_limit", "gauge", "Tokens added to a bucket per second, 0 when not limited.",
+		func(s Stats) string { return strconv.FormatFloat(s.Limit, 'g', -1, 64) }},
+	{"ratelimit_burst", "gauge", "Tokens a bucket holds at most.",
+		func(s Stats) string { return strconv.Itoa(s.Burst) }},
+}
+
+// WriteMetrics write the state of the limiters in the Prometheus text format
+func WriteMetrics(w io.Writer, limiters ...*Limiter) error {
+	stats := make([]Stats, 0, len(limiters))
+	for _, l := range limiters {
+		stats = append(stats, l.Stats())
+	}
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ); err != nil {
+			return err
+		}
+		for _, s := range stats {
+			if _, err := fmt.Fprintf(w, "%s{limiter=%q} %s\n", m.name, s.Name, m.value(s)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweepInterval idle buckets are dropped at most this often
+const sweepInterval = time.Minute
+
+// Rate tokens added per second to a bucket holding Burst at most, zero disables limiting
+type Rate struct {
+	Limit float64
+	Burst int
+}
+
+// ParseRate parse <n>/<s|m|h>, n requests per second, minute or hour with bursts of n.
+// Empty or 0 is no limit.
+func ParseRate(s string) (Rate, error) {
+	if s == "" || s == "0" {
+		return Rate{}, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Rate{}, fmt.Errorf("invalid rate %q, want <n>/<s|m|h>", s)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q, want <n>/<s|m|h>", s)
+	}
+	var per time.Duration
+	switch parts[1] {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return Rate{}, fmt.Errorf("invalid rate %q, want <n>/<s|m|h>", s)
+	}
+	return Rate{
+		Limit: float64(n) / per.Seconds(),
+		Burst: n,
+	}, nil
+}
+
+// Limiter token bucket per key, a request takes a token of the bucket of its key
+type Limiter struct {
+	name string
+	rate Rate
+	now  func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	allowed   uint64
+	rejected  uint64
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New new limiter named for the metrics
+func New(name string, rate Rate) *Limiter {
+	return &Limiter{
+		name:    name,
+		rate:    rate,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Name limiter name
+func (l *Limiter) Name() string {
+	return l.name
+}
+
+// Enabled whether the limiter has a rate
+func (l *Limiter) Enabled() bool {
+	return l.rate.Limit > 0 && l.rate.Burst > 0
+}
+
+// Allow take a token of the bucket of key, or tell how long until one is available
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if !l.Enabled() {
+		return true, 0
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.rate.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.rate.Burst), b.tokens+now.Sub(b.last).Seconds()*l.rate.Limit)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		l.allowed++
+		return true, 0
+	}
+	l.rejected++
+	wait := time.Duration((1 - b.tokens) / l.rate.Limit * float64(time.Second))
+	return false, wait
+}
+
+// sweep drop the buckets refilled to the brim, they are the same as new ones
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(float64(l.rate.Burst) / l.rate.Limit * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Stats limiter state
+type Stats struct {
+	Name     string
+	Limit    float64
+	Burst    int
+	Keys     int
+	Allowed  uint64
+	Rejected uint64
+}
+
+// Stats current state of the limiter
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Stats{
+		Name:     l.name,
+		Limit:    l.rate.Limit,
+		Burst:    l.rate.Burst,
+		Keys:     len(l.buckets),
+		Allowed:  l.allowed,
+		Rejected: l.rejected,
+	}
+}
@@ -0,0 +1,90 @@
+package ratelimit
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_ParseRate ...
+func Test_ParseRate(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Rate
+		err  bool
+	}{
+		{"", Rate{}, false},
+		{"0", Rate{}, false},
+		{"5/s", Rate{Limit: 5, Burst: 5}, false},
+		{"30/m", Rate{Limit: 0.5, Burst: 30}, false},
+		{"3600/h", Rate{Limit: 1, Burst: 3600}, false},
+		{"5", Rate{}, true},
+		{"-1/s", Rate{}, true},
+		{"5/d", Rate{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseRate(tt.s)
+			assert.Equal(t, tt.err, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// Test_Limiter ...
+func Test_Limiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := New("test", Rate{Limit: 2, Burst: 3})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a")
+		assert.True(t, ok)
+	}
+	ok, wait := l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	// keys are apart
+	ok, _ = l.Allow("b")
+	assert.True(t, ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.Allow("a")
+	assert.True(t, ok)
+	ok, _ = l.Allow("a")
+	assert.False(t, ok)
+
+	st := l.Stats()
+	assert.Equal(t, Stats{Name: "test", Limit: 2, Burst: 3, Keys: 2, Allowed: 5, Rejected: 2}, st)
+
+	// idle buckets are full again and dropped
+	now = now.Add(time.Hour)
+	ok, _ = l.Allow("c")
+	assert.True(t, ok)
+	assert.Equal(t, 1, l.Stats().Keys)
+
+	// no rate no limit
+	off := New("off", Rate{})
+	for i := 0; i < 100; i++ {
+		ok, _ = off.Allow("a")
+		assert.True(t, ok)
+	}
+}
+
+// Test_WriteMetrics ...
+func Test_WriteMetrics(t *testing.T) {
+	l := New("auth", Rate{Limit: 0.5, Burst: 1})
+	l.Allow("a")
+	l.Allow("a")
+	buf := &bytes.Buffer{}
+	assert.Nil(t, WriteMetrics(buf, l, New("api", Rate{})))
+	out := buf.String()
+	assert.True(t, strings.Contains(out, "# TYPE ratelimit_allowed_total counter\n"))
+	assert.True(t, strings.Contains(out, `ratelimit_allowed_total{limiter="auth"} 1`+"\n"))
+	assert.True(t, strings.Contains(out, `ratelimit_rejected_total{limiter="auth"} 1`+"\n"))
+	assert.True(t, strings.Contains(out, `ratelimit_limit{limiter="auth"} 0.5`+"\n"))
+	assert.True(t, strings.Contains(out, `ratelimit_keys{limiter="api"} 0`+"\n"))
+}
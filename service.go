@@ -1,17 +1,65 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/carterdings/authentication/entity"
 	"github.com/carterdings/authentication/logic"
 	"github.com/carterdings/authentication/repo/errs"
+	"github.com/carterdings/authentication/repo/ratelimit"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
+const (
+	bearerScheme = "Bearer "
+	tokenCookie  = "access_token"
+	authRealm    = "authentication"
+)
+
+// quoteEscaper keep the error description a valid quoted-string
+var quoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// statusMap HTTP status of the error codes, 500 for the unlisted ones
+var statusMap = map[int]int{
+	errs.ErrCodeSuccess:             http.StatusOK,
+	entity.ErrCodeInvalidParam:      http.StatusBadRequest,
+	entity.ErrCodeInvalidToken:      http.StatusUnauthorized,
+	entity.ErrCodeExpiredToken:      http.StatusUnauthorized,
+	entity.ErrCodeInvalidPassword:   http.StatusUnauthorized,
+	entity.ErrCodeReusedToken:       http.StatusUnauthorized,
+	entity.ErrCodePermissionDenied:  http.StatusForbidden,
+	entity.ErrCodeInvalidResetCode:  http.StatusBadRequest,
+	entity.ErrCodeInvalidOTP:        http.StatusUnauthorized,
+	entity.ErrCodeInvalidCredential: http.StatusUnauthorized,
+	entity.ErrCodeAccountLocked:     http.StatusTooManyRequests,
+	entity.ErrCodeRateLimited:       http.StatusTooManyRequests,
+	entity.ErrCodeWeakPassword:      http.StatusBadRequest,
+	entity.ErrCodeInvalidClient:     http.StatusUnauthorized,
+	entity.ErrCodeUserExists:        http.StatusConflict,
+	entity.ErrCodeUserNotExist:      http.StatusNotFound,
+	entity.ErrCodeRoleExists:        http.StatusConflict,
+	entity.ErrCodeRoleNotExist:      http.StatusNotFound,
+	entity.ErrCodeRoleNotMatch:      http.StatusForbidden,
+	entity.ErrCodeRoleCycle:         http.StatusConflict,
+	entity.ErrCodeSessionNotExist:   http.StatusNotFound,
+	entity.ErrCodeMFAConflict:       http.StatusConflict,
+	entity.ErrCodeCredentialExists:  http.StatusConflict,
+}
+
 // Service service
 type Service struct {
 	logic.AuthService
+	// Limiters rate limiters reported by Metrics
+	Limiters []*ratelimit.Limiter
+	// APIKeys keys of the services calling the checks, each rate limited on its own
+	APIKeys map[string]bool
 }
 
 // CreateUser create user handler
@@ -25,13 +73,13 @@ func (s *Service) CreateUser(c *gin.Context) {
 			rsp.Code = errs.ErrCode(err)
 			rsp.Msg = errs.ErrMsg(err)
 		}
-		c.PureJSON(http.StatusOK, gin.H{
+		c.PureJSON(httpStatus(c, err), withDetails(gin.H{
 			"code": rsp.Code,
 			"msg":  rsp.Msg,
-		})
+		}, err))
 	}()
 
-	err = c.BindJSON(req)
+	err = bindJSON(c, req)
 	if err != nil {
 		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
 		return
@@ -53,13 +101,13 @@ func (s *Service) DeleteUser(c *gin.Context) {
 			rsp.Code = errs.ErrCode(err)
 			rsp.Msg = errs.ErrMsg(err)
 		}
-		c.PureJSON(http.StatusOK, gin.H{
+		c.PureJSON(httpStatus(c, err), gin.H{
 			"code": rsp.Code,
 			"msg":  rsp.Msg,
 		})
 	}()
 
-	err = c.BindJSON(req)
+	err = bindJSON(c, req)
 	if err != nil {
 		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
 		return
@@ -81,13 +129,13 @@ func (s *Service) CreateRole(c *gin.Context) {
 			rsp.Code = errs.ErrCode(err)
 			rsp.Msg = errs.ErrMsg(err)
 		}
-		c.PureJSON(http.StatusOK, gin.H{
+		c.PureJSON(httpStatus(c, err), gin.H{
 			"code": rsp.Code,
 			"msg":  rsp.Msg,
 		})
 	}()
 
-	err = c.BindJSON(req)
+	err = bindJSON(c, req)
 	if err != nil {
 		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
 		return
@@ -109,13 +157,13 @@ func (s *Service) DeleteRole(c *gin.Context) {
 			rsp.Code = errs.ErrCode(err)
 			rsp.Msg = errs.ErrMsg(err)
 		}
-		c.PureJSON(http.StatusOK, gin.H{
+		c.PureJSON(httpStatus(c, err), gin.H{
 			"code": rsp.Code,
 			"msg":  rsp.Msg,
 		})
 	}()
 
-	err = c.BindJSON(req)
+	err = bindJSON(c, req)
 	if err != nil {
 		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
 		return
@@ -126,6 +174,118 @@ func (s *Service) DeleteRole(c *gin.Context) {
 	}
 }
 
+// AddRoleChild make a role imply a child role
+func (s *Service) AddRoleChild(c *gin.Context) {
+	req := &entity.RoleReq{}
+	rsp := &entity.CommRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code": rsp.Code,
+			"msg":  rsp.Msg,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	err = s.AuthService.AddRoleChild(req)
+	if err != nil {
+		return
+	}
+}
+
+// RemoveRoleChild drop the edge from a role to a child role
+func (s *Service) RemoveRoleChild(c *gin.Context) {
+	req := &entity.RoleReq{}
+	rsp := &entity.CommRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code": rsp.Code,
+			"msg":  rsp.Msg,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	err = s.AuthService.RemoveRoleChild(req)
+	if err != nil {
+		return
+	}
+}
+
+// GrantPermission grant a permission to a role
+func (s *Service) GrantPermission(c *gin.Context) {
+	req := &entity.PermissionReq{}
+	rsp := &entity.CommRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code": rsp.Code,
+			"msg":  rsp.Msg,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	err = s.AuthService.GrantPermission(req)
+	if err != nil {
+		return
+	}
+}
+
+// RevokePermission revoke a permission of a role
+func (s *Service) RevokePermission(c *gin.Context) {
+	req := &entity.PermissionReq{}
+	rsp := &entity.CommRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code": rsp.Code,
+			"msg":  rsp.Msg,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	err = s.AuthService.RevokePermission(req)
+	if err != nil {
+		return
+	}
+}
+
 // AddRoleToUser add role to user
 func (s *Service) AddRoleToUser(c *gin.Context) {
 	req := &entity.UserRoleReq{}
@@ -137,13 +297,13 @@ func (s *Service) AddRoleToUser(c *gin.Context) {
 			rsp.Code = errs.ErrCode(err)
 			rsp.Msg = errs.ErrMsg(err)
 		}
-		c.PureJSON(http.StatusOK, gin.H{
+		c.PureJSON(httpStatus(c, err), gin.H{
 			"code": rsp.Code,
 			"msg":  rsp.Msg,
 		})
 	}()
 
-	err = c.BindJSON(req)
+	err = bindJSON(c, req)
 	if err != nil {
 		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
 		return
@@ -154,6 +314,178 @@ func (s *Service) AddRoleToUser(c *gin.Context) {
 	}
 }
 
+// RemoveRoleFromUser remove role from user
+func (s *Service) RemoveRoleFromUser(c *gin.Context) {
+	req := &entity.UserRoleReq{}
+	rsp := &entity.CommRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code": rsp.Code,
+			"msg":  rsp.Msg,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	err = s.AuthService.RemoveRoleFromUser(req)
+	if err != nil {
+		return
+	}
+}
+
+// ChangePassword change the password of the token user
+func (s *Service) ChangePassword(c *gin.Context) {
+	req := &entity.PasswordReq{}
+	rsp := &entity.CommRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), withDetails(gin.H{
+			"code": rsp.Code,
+			"msg":  rsp.Msg,
+		}, err))
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	if req.Token == "" {
+		req.Token = bearerToken(c)
+	}
+	req.ClientIP = c.ClientIP()
+	err = s.AuthService.ChangePassword(req)
+	if err != nil {
+		return
+	}
+}
+
+// ResetPassword set the password of a user
+func (s *Service) ResetPassword(c *gin.Context) {
+	req := &entity.PasswordReq{}
+	rsp := &entity.CommRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), withDetails(gin.H{
+			"code": rsp.Code,
+			"msg":  rsp.Msg,
+		}, err))
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	err = s.AuthService.ResetPassword(req)
+	if err != nil {
+		return
+	}
+}
+
+// Unlock lift the lockout of a user or a client IP
+func (s *Service) Unlock(c *gin.Context) {
+	req := &entity.LockoutReq{}
+	rsp := &entity.CommRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code": rsp.Code,
+			"msg":  rsp.Msg,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	err = s.AuthService.Unlock(req)
+	if err != nil {
+		return
+	}
+}
+
+// ForgotPassword send a password reset code to a user
+func (s *Service) ForgotPassword(c *gin.Context) {
+	req := &entity.PasswordReq{}
+	rsp := &entity.CommRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code": rsp.Code,
+			"msg":  rsp.Msg,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	err = s.AuthService.ForgotPassword(req)
+	if err != nil {
+		return
+	}
+}
+
+// ConfirmReset set a new password with a reset code
+func (s *Service) ConfirmReset(c *gin.Context) {
+	req := &entity.PasswordReq{}
+	rsp := &entity.CommRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), withDetails(gin.H{
+			"code": rsp.Code,
+			"msg":  rsp.Msg,
+		}, err))
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	err = s.AuthService.ConfirmReset(req)
+	if err != nil {
+		return
+	}
+}
+
 // Authenticate authenticate
 func (s *Service) Authenticate(c *gin.Context) {
 	req := &entity.UserRoleReq{}
@@ -165,26 +497,31 @@ func (s *Service) Authenticate(c *gin.Context) {
 			rsp.Code = errs.ErrCode(err)
 			rsp.Msg = errs.ErrMsg(err)
 		}
-		c.PureJSON(http.StatusOK, gin.H{
-			"code":  rsp.Code,
-			"msg":   rsp.Msg,
-			"token": rsp.Token,
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code":          rsp.Code,
+			"msg":           rsp.Msg,
+			"token":         rsp.Token,
+			"refresh_token": rsp.RefreshToken,
+			"mfa_pending":   rsp.MFAPending,
+			"mfa_token":     rsp.MFAToken,
 		})
 	}()
 
-	err = c.BindJSON(req)
+	err = bindJSON(c, req)
 	if err != nil {
 		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
 		return
 	}
+	req.ClientIP = c.ClientIP()
+	req.UserAgent = c.Request.UserAgent()
 	rsp, err = s.AuthService.Authenticate(req)
 	if err != nil {
 		return
 	}
 }
 
-// Invalidate invalidate
-func (s *Service) Invalidate(c *gin.Context) {
+// Refresh exchange a refresh token for a new token pair
+func (s *Service) Refresh(c *gin.Context) {
 	req := &entity.UserRoleReq{}
 	rsp := &entity.UserRoleRsp{}
 	var err error
@@ -194,25 +531,29 @@ func (s *Service) Invalidate(c *gin.Context) {
 			rsp.Code = errs.ErrCode(err)
 			rsp.Msg = errs.ErrMsg(err)
 		}
-		c.PureJSON(http.StatusOK, gin.H{
-			"code": rsp.Code,
-			"msg":  rsp.Msg,
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code":          rsp.Code,
+			"msg":           rsp.Msg,
+			"token":         rsp.Token,
+			"refresh_token": rsp.RefreshToken,
 		})
 	}()
 
-	err = c.BindJSON(req)
+	err = bindJSON(c, req)
 	if err != nil {
 		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
 		return
 	}
-	err = s.AuthService.Invalidate(req)
+	req.ClientIP = c.ClientIP()
+	req.UserAgent = c.Request.UserAgent()
+	rsp, err = s.AuthService.Refresh(req)
 	if err != nil {
 		return
 	}
 }
 
-// CheckRole check role
-func (s *Service) CheckRole(c *gin.Context) {
+// Invalidate invalidate
+func (s *Service) Invalidate(c *gin.Context) {
 	req := &entity.UserRoleReq{}
 	rsp := &entity.UserRoleRsp{}
 	var err error
@@ -222,28 +563,30 @@ func (s *Service) CheckRole(c *gin.Context) {
 			rsp.Code = errs.ErrCode(err)
 			rsp.Msg = errs.ErrMsg(err)
 		}
-		c.PureJSON(http.StatusOK, gin.H{
-			"code":         rsp.Code,
-			"msg":          rsp.Msg,
-			"check_result": rsp.CheckResult,
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code": rsp.Code,
+			"msg":  rsp.Msg,
 		})
 	}()
 
-	err = c.BindJSON(req)
+	err = bindJSON(c, req)
 	if err != nil {
 		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
 		return
 	}
-	rsp, err = s.AuthService.CheckRole(req)
+	if req.Token == "" {
+		req.Token = bearerToken(c)
+	}
+	err = s.AuthService.Invalidate(req)
 	if err != nil {
 		return
 	}
 }
 
-// AllRoles all roles
-func (s *Service) AllRoles(c *gin.Context) {
-	req := &entity.UserRoleReq{}
-	rsp := &entity.UserRoleRsp{}
+// EnrollTOTP generate a TOTP secret for the token user
+func (s *Service) EnrollTOTP(c *gin.Context) {
+	req := &entity.MFAReq{}
+	rsp := &entity.MFARsp{}
 	var err error
 
 	defer func() {
@@ -251,20 +594,709 @@ func (s *Service) AllRoles(c *gin.Context) {
 			rsp.Code = errs.ErrCode(err)
 			rsp.Msg = errs.ErrMsg(err)
 		}
-		c.PureJSON(http.StatusOK, gin.H{
-			"code":  rsp.Code,
-			"msg":   rsp.Msg,
-			"roles": rsp.Roles,
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code":   rsp.Code,
+			"msg":    rsp.Msg,
+			"secret": rsp.Secret,
+			"uri":    rsp.URI,
 		})
 	}()
 
-	err = c.BindJSON(req)
+	err = bindJSON(c, req)
 	if err != nil {
 		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
 		return
 	}
-	rsp, err = s.AuthService.AllRoles(req)
+	if req.Token == "" {
+		req.Token = bearerToken(c)
+	}
+	rsp, err = s.AuthService.EnrollTOTP(req)
 	if err != nil {
 		return
 	}
 }
+
+// ConfirmTOTP enable TOTP with a code of the enrolled secret
+func (s *Service) ConfirmTOTP(c *gin.Context) {
+	req := &entity.MFAReq{}
+	rsp := &entity.MFARsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code":           rsp.Code,
+			"msg":            rsp.Msg,
+			"recovery_codes": rsp.RecoveryCodes,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	if req.Token == "" {
+		req.Token = bearerToken(c)
+	}
+	rsp, err = s.AuthService.ConfirmTOTP(req)
+	if err != nil {
+		return
+	}
+}
+
+// DisableTOTP turn TOTP off with a current code
+func (s *Service) DisableTOTP(c *gin.Context) {
+	req := &entity.MFAReq{}
+	rsp := &entity.CommRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code": rsp.Code,
+			"msg":  rsp.Msg,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	if req.Token == "" {
+		req.Token = bearerToken(c)
+	}
+	req.ClientIP = c.ClientIP()
+	err = s.AuthService.DisableTOTP(req)
+	if err != nil {
+		return
+	}
+}
+
+// CompleteMFA complete an authentication with the second factor
+func (s *Service) CompleteMFA(c *gin.Context) {
+	req := &entity.MFAReq{}
+	rsp := &entity.UserRoleRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code":          rsp.Code,
+			"msg":           rsp.Msg,
+			"token":         rsp.Token,
+			"refresh_token": rsp.RefreshToken,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	rsp, err = s.AuthService.CompleteMFA(req)
+	if err != nil {
+		return
+	}
+}
+
+// RecoveryCodes number of the unused recovery codes
+func (s *Service) RecoveryCodes(c *gin.Context) {
+	req := &entity.MFAReq{}
+	rsp := &entity.MFARsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code":      rsp.Code,
+			"msg":       rsp.Msg,
+			"remaining": rsp.Remaining,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	if req.Token == "" {
+		req.Token = bearerToken(c)
+	}
+	rsp, err = s.AuthService.RecoveryCodes(req)
+	if err != nil {
+		return
+	}
+}
+
+// RegenerateRecoveryCodes replace the recovery codes
+func (s *Service) RegenerateRecoveryCodes(c *gin.Context) {
+	req := &entity.MFAReq{}
+	rsp := &entity.MFARsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code":           rsp.Code,
+			"msg":            rsp.Msg,
+			"recovery_codes": rsp.RecoveryCodes,
+			"remaining":      rsp.Remaining,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	if req.Token == "" {
+		req.Token = bearerToken(c)
+	}
+	req.ClientIP = c.ClientIP()
+	rsp, err = s.AuthService.RegenerateRecoveryCodes(req)
+	if err != nil {
+		return
+	}
+}
+
+// BeginRegistration start registering a WebAuthn credential
+func (s *Service) BeginRegistration(c *gin.Context) {
+	req := &entity.WebAuthnReq{}
+	rsp := &entity.WebAuthnRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code":    rsp.Code,
+			"msg":     rsp.Msg,
+			"options": rsp.Options,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	if req.Token == "" {
+		req.Token = bearerToken(c)
+	}
+	rsp, err = s.AuthService.BeginRegistration(req)
+	if err != nil {
+		return
+	}
+}
+
+// FinishRegistration register the WebAuthn credential created by the authenticator
+func (s *Service) FinishRegistration(c *gin.Context) {
+	req := &entity.WebAuthnReq{}
+	rsp := &entity.WebAuthnRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code": rsp.Code,
+			"msg":  rsp.Msg,
+			"id":   rsp.ID,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	if req.Token == "" {
+		req.Token = bearerToken(c)
+	}
+	rsp, err = s.AuthService.FinishRegistration(req)
+	if err != nil {
+		return
+	}
+}
+
+// BeginLogin start a WebAuthn login
+func (s *Service) BeginLogin(c *gin.Context) {
+	req := &entity.WebAuthnReq{}
+	rsp := &entity.WebAuthnRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code":    rsp.Code,
+			"msg":     rsp.Msg,
+			"options": rsp.Options,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	rsp, err = s.AuthService.BeginLogin(req)
+	if err != nil {
+		return
+	}
+}
+
+// FinishLogin log in with the WebAuthn assertion of the authenticator
+func (s *Service) FinishLogin(c *gin.Context) {
+	req := &entity.WebAuthnReq{}
+	rsp := &entity.UserRoleRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code":          rsp.Code,
+			"msg":           rsp.Msg,
+			"token":         rsp.Token,
+			"refresh_token": rsp.RefreshToken,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	req.ClientIP = c.ClientIP()
+	req.UserAgent = c.Request.UserAgent()
+	rsp, err = s.AuthService.FinishLogin(req)
+	if err != nil {
+		return
+	}
+}
+
+// ListSessions list the active sessions of a user
+func (s *Service) ListSessions(c *gin.Context) {
+	req := &entity.SessionReq{}
+	rsp := &entity.SessionRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code":     rsp.Code,
+			"msg":      rsp.Msg,
+			"sessions": rsp.Sessions,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	if req.Token == "" {
+		req.Token = bearerToken(c)
+	}
+	rsp, err = s.AuthService.ListSessions(req)
+	if err != nil {
+		return
+	}
+}
+
+// RevokeSession revoke one session of a user
+func (s *Service) RevokeSession(c *gin.Context) {
+	req := &entity.SessionReq{}
+	rsp := &entity.CommRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code": rsp.Code,
+			"msg":  rsp.Msg,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	if req.Token == "" {
+		req.Token = bearerToken(c)
+	}
+	err = s.AuthService.RevokeSession(req)
+	if err != nil {
+		return
+	}
+}
+
+// RevokeAllSessions revoke all sessions of a user
+func (s *Service) RevokeAllSessions(c *gin.Context) {
+	req := &entity.SessionReq{}
+	rsp := &entity.CommRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code": rsp.Code,
+			"msg":  rsp.Msg,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	if req.Token == "" {
+		req.Token = bearerToken(c)
+	}
+	err = s.AuthService.RevokeAllSessions(req)
+	if err != nil {
+		return
+	}
+}
+
+// CheckRole check role
+func (s *Service) CheckRole(c *gin.Context) {
+	req := &entity.UserRoleReq{}
+	rsp := &entity.UserRoleRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code":         rsp.Code,
+			"msg":          rsp.Msg,
+			"check_result": rsp.CheckResult,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	if req.Token == "" {
+		req.Token = bearerToken(c)
+	}
+	rsp, err = s.AuthService.CheckRole(req)
+	if err != nil {
+		return
+	}
+}
+
+// AllRoles all roles
+func (s *Service) AllRoles(c *gin.Context) {
+	req := &entity.UserRoleReq{}
+	rsp := &entity.UserRoleRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code":  rsp.Code,
+			"msg":   rsp.Msg,
+			"roles": rsp.Roles,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	if req.Token == "" {
+		req.Token = bearerToken(c)
+	}
+	rsp, err = s.AuthService.AllRoles(req)
+	if err != nil {
+		return
+	}
+}
+
+// CheckPermission check the token user is allowed a permission
+func (s *Service) CheckPermission(c *gin.Context) {
+	req := &entity.PermissionReq{}
+	rsp := &entity.PermissionRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code":         rsp.Code,
+			"msg":          rsp.Msg,
+			"check_result": rsp.CheckResult,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	if req.Token == "" {
+		req.Token = bearerToken(c)
+	}
+	rsp, err = s.AuthService.CheckPermission(req)
+	if err != nil {
+		return
+	}
+}
+
+// RequireAdmin middleware letting through callers whose bearer token belongs to an admin
+func (s *Service) RequireAdmin(c *gin.Context) {
+	err := s.AuthService.CheckAdmin(&entity.UserRoleReq{Token: bearerToken(c)})
+	if err != nil {
+		c.AbortWithStatusJSON(httpStatus(c, err), gin.H{
+			"code": errs.ErrCode(err),
+			"msg":  errs.ErrMsg(err),
+		})
+		return
+	}
+	c.Next()
+}
+
+// RateLimit middleware rejecting the requests over the rate of l, counted per key
+func (s *Service) RateLimit(l *ratelimit.Limiter, key func(c *gin.Context) string) gin.HandlerFunc {
+	s.Limiters = append(s.Limiters, l)
+	return func(c *gin.Context) {
+		ok, wait := l.Allow(key(c))
+		if !ok {
+			// whole seconds, rounded up so that a retry is let through
+			c.Header("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			err := errs.New(entity.ErrCodeRateLimited, "Too many requests")
+			c.AbortWithStatusJSON(httpStatus(c, err), gin.H{
+				"code": errs.ErrCode(err),
+				"msg":  errs.ErrMsg(err),
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// KeyByIP rate limit key of the client IP
+func KeyByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// KeyByAPIKey rate limit key of the X-API-Key header if it holds a known key, the client IP otherwise.
+// Made-up keys get no bucket of their own.
+func (s *Service) KeyByAPIKey(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" && s.APIKeys[key] {
+		return "key:" + key
+	}
+	return KeyByIP(c)
+}
+
+// KeyByUser rate limit key of the user of the bearer token, the client IP without a valid one
+func (s *Service) KeyByUser(c *gin.Context) string {
+	req := &entity.UserRoleReq{Token: bearerToken(c)}
+	if req.Token == "" || s.AuthService.Identify(req) != nil {
+		return KeyByIP(c)
+	}
+	return "user:" + req.UserName
+}
+
+// Metrics state of the rate limiters in the Prometheus text format
+func (s *Service) Metrics(c *gin.Context) {
+	buf := &bytes.Buffer{}
+	ratelimit.WriteMetrics(buf, s.Limiters...)
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+}
+
+// JWKS public keys verifying tokens, as a standard JSON Web Key Set
+func (s *Service) JWKS(c *gin.Context) {
+	c.PureJSON(http.StatusOK, s.AuthService.JWKS())
+}
+
+// Introspect tell a client whether a token is active, RFC 7662. The token comes in a form
+// or JSON body, the client credentials in the Authorization header.
+func (s *Service) Introspect(c *gin.Context) {
+	req := &entity.IntrospectReq{}
+	rsp := &entity.IntrospectRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.Header("Cache-Control", "no-store")
+		c.PureJSON(httpStatus(c, err), rsp)
+	}()
+
+	err = c.ShouldBind(req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	req.ClientID, req.ClientSecret, _ = c.Request.BasicAuth()
+	rsp, err = s.AuthService.Introspect(req)
+	if err != nil {
+		return
+	}
+}
+
+// Snapshot dump the store to a snapshot file
+func (s *Service) Snapshot(c *gin.Context) {
+	req := &entity.SnapshotReq{}
+	rsp := &entity.SnapshotRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code":    rsp.Code,
+			"msg":     rsp.Msg,
+			"entries": rsp.Entries,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	rsp, err = s.AuthService.Snapshot(req)
+	if err != nil {
+		return
+	}
+}
+
+// Restore load a snapshot file into the store
+func (s *Service) Restore(c *gin.Context) {
+	req := &entity.SnapshotReq{}
+	rsp := &entity.SnapshotRsp{}
+	var err error
+
+	defer func() {
+		if err != nil {
+			rsp.Code = errs.ErrCode(err)
+			rsp.Msg = errs.ErrMsg(err)
+		}
+		c.PureJSON(httpStatus(c, err), gin.H{
+			"code":    rsp.Code,
+			"msg":     rsp.Msg,
+			"entries": rsp.Entries,
+		})
+	}()
+
+	err = bindJSON(c, req)
+	if err != nil {
+		err = errs.New(entity.ErrCodeInvalidParam, err.Error())
+		return
+	}
+	rsp, err = s.AuthService.Restore(req)
+	if err != nil {
+		return
+	}
+}
+
+// bearerToken token of the Authorization: Bearer header, or of the token cookie.
+// Browsers send the cookie along cross-site forms too, it is only taken from JSON requests,
+// which no other site can make without a CORS preflight.
+func bearerToken(c *gin.Context) string {
+	auth := c.GetHeader("Authorization")
+	if len(auth) > len(bearerScheme) && strings.EqualFold(auth[:len(bearerScheme)], bearerScheme) {
+		return strings.TrimSpace(auth[len(bearerScheme):])
+	}
+	if c.ContentType() != binding.MIMEJSON {
+		return ""
+	}
+	token, err := c.Cookie(tokenCookie)
+	if err != nil {
+		return ""
+	}
+	return token
+}
+
+// bindJSON bind the request body, an empty body leaves req as is.
+// Unlike c.BindJSON it writes nothing, the handler answers with its own envelope.
+func bindJSON(c *gin.Context, req interface{}) error {
+	err := c.ShouldBindJSON(req)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// withDetails add the details of err to the response body, if it has any
+func withDetails(body gin.H, err error) gin.H {
+	if details := errs.ErrDetails(err); len(details) > 0 {
+		body["details"] = details
+	}
+	return body
+}
+
+// httpStatus HTTP status of err, the WWW-Authenticate challenge of RFC 6750 is set along a 401 or 403
+func httpStatus(c *gin.Context, err error) int {
+	code := errs.ErrCode(err)
+	status, ok := statusMap[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	switch {
+	case code == entity.ErrCodeInvalidClient:
+		c.Header("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, authRealm))
+	case status == http.StatusUnauthorized && (code == entity.ErrCodeInvalidToken || code == entity.ErrCodeExpiredToken):
+		c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s", error="invalid_token", error_description="%s"`,
+			authRealm, quoteEscaper.Replace(errs.ErrMsg(err))))
+	case status == http.StatusUnauthorized:
+		c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s"`, authRealm))
+	case status == http.StatusForbidden:
+		c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s", error="insufficient_scope"`, authRealm))
+	}
+	return status
+}